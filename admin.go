@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schani/reloadcache/keep"
+)
+
+var adminToken string
+
+// adminHandler requires requests to h to carry the admin token, if one
+// is configured.
+func adminHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken != "" {
+			given := []byte(r.Header.Get("Authorization"))
+			expected := []byte("Bearer " + adminToken)
+			if subtle.ConstantTimeCompare(given, expected) != 1 {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+type primeResult struct {
+	Path  string `json:"path"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+var primeConcurrency = 4
+
+// maxAdminBody is the maximum size of the request bodies of the admin
+// handlers.
+const maxAdminBody = 1 << 20
+
+// primeHandler fetches the JSON array of paths in the request body into
+// the cache and reports on each.  If any fail or are not cached the
+// status is Bad Gateway.
+func primeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method supported", http.StatusBadRequest)
+		return
+	}
+
+	var paths []string
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody)).Decode(&paths)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]primeResult, len(paths))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < primeConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = prime(paths[i])
+			}
+		}()
+	}
+	for i := range paths {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	status := http.StatusOK
+	for _, result := range results {
+		if !result.OK {
+			status = http.StatusBadGateway
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	err = json.NewEncoder(w).Encode(results)
+	if err != nil {
+		fmt.Printf("write error")
+	}
+}
+
+func prime(rawPath string) primeResult {
+	u, err := url.Parse(rawPath)
+	if err != nil {
+		return primeResult{Path: rawPath, Error: err.Error()}
+	}
+	path := requestPath(u)
+
+	fmt.Printf("priming %s\n", path)
+	err = theKeep.Prime(path)
+	if err != nil {
+		return primeResult{Path: path, Error: err.Error()}
+	}
+	return primeResult{Path: path, OK: true}
+}
+
+// warmHandler primes the JSON array of stages of paths in the request
+// body into the cache, one stage after the other, and reports on each
+// stage.  If any path fails the status is Bad Gateway.
+func warmHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method supported", http.StatusBadRequest)
+		return
+	}
+
+	var rawStages [][]string
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody)).Decode(&rawStages)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stages := make([][]string, len(rawStages))
+	for i, rawPaths := range rawStages {
+		for _, rawPath := range rawPaths {
+			u, err := url.Parse(rawPath)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			stages[i] = append(stages[i], requestPath(u))
+		}
+	}
+
+	results := theKeep.WarmStaged(stages, primeConcurrency, func(result keep.StageResult) {
+		fmt.Printf("warmed stage %d: %d paths, %d failed, in %s\n", result.Stage, result.Paths, result.Failed, result.Duration)
+	})
+
+	status := http.StatusOK
+	for _, result := range results {
+		if result.Failed > 0 {
+			status = http.StatusBadGateway
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	err = json.NewEncoder(w).Encode(results)
+	if err != nil {
+		fmt.Printf("write error")
+	}
+}
+
+type entryError struct {
+	Path  string    `json:"path"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// errorsHandler lists the entries whose last fetch failed, with the
+// errors.
+func errorsHandler(w http.ResponseWriter, r *http.Request) {
+	infos := entryInfos(theKeep.Dump())
+	sort.Sort(infos)
+
+	errors := []entryError{}
+	for _, ei := range infos {
+		if ei.LastErr != nil {
+			errors = append(errors, entryError{Path: ei.Path, Error: ei.LastErr.Error(), Time: ei.LastErrTime})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err := json.NewEncoder(w).Encode(errors)
+	if err != nil {
+		fmt.Printf("write error")
+	}
+}
+
+// pauseHandler returns a handler that pauses or resumes refreshes.
+func pauseHandler(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Only POST method supported", http.StatusBadRequest)
+			return
+		}
+
+		if pause {
+			theKeep.Pause()
+		} else {
+			theKeep.Resume()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// invalidateHandler invalidates the entries with the label given as
+// key=value in the label parameter.
+func invalidateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method supported", http.StatusBadRequest)
+		return
+	}
+
+	label := strings.SplitN(r.FormValue("label"), "=", 2)
+	if len(label) != 2 {
+		http.Error(w, "label parameter must be key=value", http.StatusBadRequest)
+		return
+	}
+
+	theKeep.InvalidateByLabel(label[0], label[1])
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// refreshHandler has the path given in the path parameter refetched,
+// and responds with a token.  Passing it in the X-Refresh-Token header
+// of a request for the path makes that wait for the refetched data.
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST method supported", http.StatusBadRequest)
+		return
+	}
+
+	u, err := url.Parse(r.FormValue("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	path := requestPath(u)
+	token := theKeep.Refresh(path)
+	if token == 0 {
+		http.Error(w, "Path is not in the keep", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	fmt.Fprintf(w, "%d\n", token)
+}
+
+// keepConfig is the part of the keep's settings that configHandler
+// reports and changes, named after the flags that set them.
+type keepConfig struct {
+	Expire     int    `json:"expire"`
+	Decay      int    `json:"decay"`
+	MaxFetches int    `json:"max-fetches"`
+	Validate   bool   `json:"validate"`
+	Waiters    string `json:"waiters"`
+	MaxWaiters int    `json:"max-waiters"`
+	MaxBytes   int64  `json:"max-bytes"`
+	Eviction   string `json:"eviction"`
+}
+
+func newKeepConfig(cfg keep.Config) keepConfig {
+	kc := keepConfig{Expire: int(cfg.ExpireDuration / time.Second),
+		Decay:      cfg.NumExpiresToDecay,
+		MaxFetches: cfg.MaxFetches,
+		Validate:   cfg.ValidateRefreshes,
+		MaxWaiters: cfg.MaxWaiters,
+		MaxBytes:   cfg.MaxBytes,
+		Eviction:   cfg.EvictionPolicy.Name()}
+	for name, strategy := range waiterStrategies {
+		if strategy == cfg.WaiterStrategy {
+			kc.Waiters = name
+		}
+	}
+	return kc
+}
+
+// applyConfigParams changes the settings in cfg given as parameters of
+// r, which are named like the flags.
+func applyConfigParams(cfg *keep.Config, r *http.Request) error {
+	ints := map[string]*int{"decay": &cfg.NumExpiresToDecay,
+		"max-fetches": &cfg.MaxFetches,
+		"max-waiters": &cfg.MaxWaiters}
+	for name, setting := range ints {
+		if value := r.FormValue(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("Invalid %s: %s", name, value)
+			}
+			*setting = n
+		}
+	}
+	if value := r.FormValue("expire"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("Invalid expire: %s", value)
+		}
+		cfg.ExpireDuration = time.Duration(seconds) * time.Second
+	}
+	if value := r.FormValue("validate"); value != "" {
+		validate, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("Invalid validate: %s", value)
+		}
+		cfg.ValidateRefreshes = validate
+	}
+	if value := r.FormValue("max-bytes"); value != "" {
+		max, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid max-bytes: %s", value)
+		}
+		cfg.MaxBytes = max
+	}
+	if value := r.FormValue("waiters"); value != "" {
+		strategy, ok := waiterStrategies[value]
+		if !ok {
+			return fmt.Errorf("Unknown waiters strategy: %s", value)
+		}
+		cfg.WaiterStrategy = strategy
+	}
+	if value := r.FormValue("eviction"); value != "" {
+		policy, ok := evictionPolicies[value]
+		if !ok {
+			return fmt.Errorf("Unknown eviction policy: %s", value)
+		}
+		cfg.EvictionPolicy = policy
+	}
+	return nil
+}
+
+// configHandler responds with the keep's settings that can be changed
+// while it's running.  A POST changes those given as parameters, named
+// like the flags, e.g. expire=300&max-bytes=1000000, and responds with
+// the new settings.  Everything else, like the server, its client and
+// the goroutine limit, is fixed at startup.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := theKeep.Config()
+	if r.Method == "POST" {
+		err := applyConfigParams(&cfg, r)
+		if err == nil {
+			err = theKeep.Reconfigure(cfg)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Printf("reconfigured: %+v\n", newKeepConfig(cfg))
+	} else if r.Method != "GET" {
+		http.Error(w, "Only GET and POST methods supported", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err := json.NewEncoder(w).Encode(newKeepConfig(cfg))
+	if err != nil {
+		fmt.Printf("write error")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func decodePrimeResults(t *testing.T, body string) []primeResult {
+	t.Helper()
+	var results []primeResult
+	if err := json.Unmarshal([]byte(body), &results); err != nil {
+		t.Fatalf("bad response %q: %v", body, err)
+	}
+	return results
+}
+
+func TestPrime(t *testing.T) {
+	c := newTestCache()
+	useKeep(t, c, 0)
+
+	w := serve(primeHandler, "POST", "/admin/prime", `["/a", "/b?x=1"]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	for _, result := range decodePrimeResults(t, w.Body.String()) {
+		if !result.OK {
+			t.Errorf("%s: not primed: %s", result.Path, result.Error)
+		}
+	}
+	for _, path := range []string{"/a", "/b?x=1"} {
+		eventually(t, path+" to be cached", func() bool {
+			_, err := c.Get(path)
+			return err == nil
+		})
+	}
+}
+
+func TestPrimeNotCached(t *testing.T) {
+	// Every fetch is faster than the threshold, so none is cached.
+	useKeep(t, newTestCache(), time.Hour)
+
+	w := serve(primeHandler, "POST", "/admin/prime", `["/a"]`)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("got status %d for a path that wasn't cached", w.Code)
+	}
+	results := decodePrimeResults(t, w.Body.String())
+	if len(results) != 1 || results[0].OK || results[0].Error == "" {
+		t.Errorf("got %+v", results)
+	}
+}
+
+func TestPrimeBodyTooLarge(t *testing.T) {
+	useKeep(t, newTestCache(), 0)
+
+	body := `["/` + strings.Repeat("a", maxAdminBody) + `"]`
+	if w := serve(primeHandler, "POST", "/admin/prime", body); w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a body over the limit", w.Code)
+	}
+	if w := serve(warmHandler, "POST", "/admin/warm", "["+body+"]"); w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a warm body over the limit", w.Code)
+	}
+}
+
+func TestRefreshNormalizesPath(t *testing.T) {
+	c := newTestCache()
+	useKeep(t, c, 0)
+	normalizePaths = true
+	defer func() { normalizePaths = false }()
+
+	if err := theKeep.Prime("/a/b"); err != nil {
+		t.Fatal(err)
+	}
+	w := serve(refreshHandler, "POST", "/admin/refresh?path=/a//./b", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if token := strings.TrimSpace(w.Body.String()); token == "" || token == "0" {
+		t.Errorf("got token %q", token)
+	}
+	if w := serve(refreshHandler, "POST", "/admin/refresh?path=/missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("got status %d for a path that isn't kept", w.Code)
+	}
+}
+
+func decodeConfig(t *testing.T, body string) keepConfig {
+	t.Helper()
+	var cfg keepConfig
+	if err := json.Unmarshal([]byte(body), &cfg); err != nil {
+		t.Fatalf("bad response %q: %v", body, err)
+	}
+	return cfg
+}
+
+func TestConfigHandler(t *testing.T) {
+	useKeep(t, newTestCache(), 0)
+
+	w := serve(configHandler, "GET", "/admin/config", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if cfg := decodeConfig(t, w.Body.String()); cfg.Expire != 3600 || cfg.Decay != 5 || cfg.Waiters != "loop" || cfg.Eviction != "lru" {
+		t.Errorf("got %+v", cfg)
+	}
+
+	w = serve(configHandler, "POST", "/admin/config?expire=300&max-bytes=1000&eviction=size&waiters=async&validate=true", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	want := keepConfig{Expire: 300, Decay: 5, Validate: true, Waiters: "async", MaxBytes: 1000, Eviction: "size"}
+	got := decodeConfig(t, w.Body.String())
+	if got != want {
+		t.Errorf("reconfigured to %+v, want %+v", got, want)
+	}
+	cfg := theKeep.Config()
+	if cfg.ExpireDuration != 300*time.Second || cfg.MaxBytes != 1000 || cfg.EvictionPolicy.Name() != "size" {
+		t.Errorf("keep has %+v", cfg)
+	}
+}
+
+func TestConfigHandlerInvalid(t *testing.T) {
+	useKeep(t, newTestCache(), 0)
+
+	for _, query := range []string{"expire=0", "expire=soon", "eviction=random", "waiters=never", "max-bytes=-1"} {
+		if w := serve(configHandler, "POST", "/admin/config?"+query, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d", query, w.Code)
+		}
+	}
+	if cfg := theKeep.Config(); cfg.ExpireDuration != time.Hour || cfg.MaxBytes != 0 {
+		t.Errorf("invalid settings changed the keep to %+v", cfg)
+	}
+	if w := serve(configHandler, "DELETE", "/admin/config", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for DELETE", w.Code)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/schani/reloadcache/keep"
+)
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		ifNoneMatch string
+		etag        string
+		want        bool
+	}{
+		{"", `W/"a"`, false},
+		{`W/"a"`, `W/"a"`, true},
+		{`"a"`, `W/"a"`, true},
+		{`"b", W/"a"`, `W/"a"`, true},
+		{`"b"`, `W/"a"`, false},
+		{"*", `W/"a"`, true},
+	}
+	for _, test := range tests {
+		if got := etagMatches(test.ifNoneMatch, test.etag); got != test.want {
+			t.Errorf("etagMatches(%q, %q) = %v", test.ifNoneMatch, test.etag, got)
+		}
+	}
+}
+
+func TestETagWithEncodedVariant(t *testing.T) {
+	c := newTestCache()
+	useKeep(t, c, 0)
+	theEncodings = []string{"gzip"}
+	defer func() { theEncodings = nil }()
+
+	if err := theKeep.Prime("/a"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the data to be cached", func() bool {
+		_, err := c.Get("/a")
+		return err == nil
+	})
+	etag := theKeep.ETag("/a")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+	gzipped := new(bytes.Buffer)
+	gw := gzip.NewWriter(gzipped)
+	gw.Write([]byte("data /a"))
+	gw.Close()
+	c.Set(keep.VariantKey("/a", "gzip"), gzipped.Bytes())
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/a", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		cacheHandler(w, r)
+		return w
+	}
+
+	w := get(etag)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != etag {
+		t.Errorf("got status %d, ETag %q for a matching ETag", w.Code, w.Header().Get("ETag"))
+	}
+
+	w = get(`W/"other"`)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != etag || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("got status %d, ETag %q, Content-Encoding %q", w.Code, w.Header().Get("ETag"), w.Header().Get("Content-Encoding"))
+	}
+	if !bytes.Equal(w.Body.Bytes(), gzipped.Bytes()) {
+		t.Error("didn't serve the stored variant")
+	}
+
+	// The identity encoding has the same ETag.
+	w = serve(cacheHandler, "GET", "/a", "")
+	if w.Body.String() != "data /a" || w.Header().Get("ETag") != etag || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("got %q, ETag %q, Content-Encoding %q", w.Body, w.Header().Get("ETag"), w.Header().Get("Content-Encoding"))
+	}
+}
@@ -0,0 +1,55 @@
+package keep
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAliasesFetchedOnce(t *testing.T) {
+	c := newTestCache()
+	c.setBody("/a", "v1")
+	k := NewKeep(c, 50*time.Millisecond, 5, 0)
+	// Both paths are fetched from /a.
+	k.SetUpstreamMapper(func(path string) string { return strings.Split(path, "?")[0] })
+	go k.Run()
+	k.Pause()
+
+	for _, path := range []string{"/a?x=1", "/a?x=2"} {
+		if err := k.Prime(path); err != nil {
+			t.Fatal(err)
+		}
+		waitWritten(t, k, path)
+	}
+	if n := c.fetchCount("/a"); n != 2 {
+		t.Fatalf("%d fetches priming", n)
+	}
+	for len(c.started) > 0 {
+		<-c.started
+	}
+
+	// Resuming refreshes both expired paths in one pass.
+	time.Sleep(100 * time.Millisecond)
+	c.hold("/a")
+	c.setBody("/a", "v2")
+	k.Resume()
+	waitStarted(t, c, "/a")
+	for _, path := range []string{"/a?x=1", "/a?x=2"} {
+		if ei, _ := entryInfo(k, path); !ei.Fetching {
+			t.Errorf("%s not refreshed with its alias", path)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := c.fetchCount("/a"); n != 3 {
+		t.Errorf("%d fetches after refreshing the aliases", n)
+	}
+
+	k.Pause()
+	c.release("/a")
+	for _, path := range []string{"/a?x=1", "/a?x=2"} {
+		eventually(t, path+" to be refreshed", func() bool {
+			data, _ := c.stored(path)
+			return data == "v2"
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package keep
+
+import "time"
+
+// The weight of a new observation in the moving averages.
+const tuneWeight = 0.2
+
+// SetAutoTune makes the keep lengthen its refresh interval while the
+// upstream is slower than latencyTarget on average or fails more often
+// than maxErrorRate, up to maxInterval.  When the upstream is healthy
+// the interval shortens back to the expire duration.  It must be called
+// before Run.
+func (k *Keep) SetAutoTune(maxInterval time.Duration, latencyTarget time.Duration, maxErrorRate float64) {
+	k.maxRefreshInterval = maxInterval
+	k.latencyTarget = latencyTarget
+	k.maxErrorRate = maxErrorRate
+}
+
+// observeFetch updates the moving averages of fetch latency and error
+// rate.
+func (k *Keep) observeFetch(result fetchResult) {
+	errorValue := 0.0
+	if result.Err != nil {
+		errorValue = 1.0
+	}
+	k.averageLatency = time.Duration((1-tuneWeight)*float64(k.averageLatency) + tuneWeight*float64(result.duration))
+	k.errorRate = (1-tuneWeight)*k.errorRate + tuneWeight*errorValue
+}
+
+func (k *Keep) tuneRefreshInterval() {
+	if k.maxRefreshInterval <= k.expireDuration {
+		return
+	}
+
+	if k.averageLatency > k.latencyTarget || k.errorRate > k.maxErrorRate {
+		k.refreshInterval = k.refreshInterval * 5 / 4
+		if k.refreshInterval > k.maxRefreshInterval {
+			k.refreshInterval = k.maxRefreshInterval
+		}
+	} else {
+		previous := k.refreshInterval
+		k.refreshInterval = k.refreshInterval * 4 / 5
+		if k.refreshInterval < k.expireDuration {
+			k.refreshInterval = k.expireDuration
+		}
+		// Entries expiring earlier would otherwise be
+		// refetched at their old times.
+		if k.refreshInterval != previous {
+			k.rescheduleAll()
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package keep
+
+import (
+	"fmt"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	// No refreshes until breakerOpenUntil.
+	breakerOpen
+	// A single refresh is let through to see whether the upstream
+	// is back.
+	breakerProbing
+)
+
+// The number of fetches to see before the error rate is trusted.
+const breakerMinFetches = 10
+
+// SetBreaker makes the keep pause all refreshes for cooldown when the
+// error rate of fetches rises above threshold, to stop hammering an
+// upstream that's down.  Data in the cache is still served.  After the
+// cooldown a single refresh probes the upstream, and refreshes resume
+// if it succeeds.  onBreaker, if not nil, is called in a new goroutine
+// whenever the breaker opens or closes.  A zero threshold, the
+// default, disables the breaker.  It must be called before Run.
+func (k *Keep) SetBreaker(threshold float64, cooldown time.Duration, onBreaker func(open bool)) {
+	k.breakerThreshold = threshold
+	k.breakerCooldown = cooldown
+	k.onBreaker = onBreaker
+}
+
+func (k *Keep) openBreaker() {
+	fmt.Printf("upstream is failing - pausing refreshes\n")
+	wasOpen := k.breakerState != breakerClosed
+	k.breakerState = breakerOpen
+	k.breakerOpenUntil = time.Now().Add(k.breakerCooldown)
+	k.stopTimer()
+	if !wasOpen && k.onBreaker != nil {
+		go k.onBreaker(true)
+	}
+}
+
+func (k *Keep) closeBreaker() {
+	fmt.Printf("upstream is back - resuming refreshes\n")
+	k.breakerState = breakerClosed
+	k.errorRate = 0
+	if k.onBreaker != nil {
+		go k.onBreaker(false)
+	}
+}
+
+func (k *Keep) updateBreaker(result fetchResult) {
+	if k.breakerThreshold <= 0 {
+		return
+	}
+
+	switch k.breakerState {
+	case breakerClosed:
+		if k.stats.Fetches >= breakerMinFetches && k.errorRate > k.breakerThreshold {
+			k.openBreaker()
+		}
+	case breakerProbing:
+		if result.Err != nil {
+			k.openBreaker()
+		} else {
+			k.closeBreaker()
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package keep
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// An EntrySpec is a path to register, with its settings.
+type EntrySpec struct {
+	Path string
+	// TTL is the entry's SoftTTL, and MaxServedAge its
+	// MaxServedAge.  Zero means there is none.
+	TTL          time.Duration
+	MaxServedAge time.Duration
+	Labels       map[string]string
+	// Pinned entries are kept warm without decaying, as with
+	// Register.  Unpinned ones decay as if they were requested
+	// once.
+	Pinned    bool
+	Immutable bool
+	// Upstream is the path to fetch from the upstream, if it's not
+	// Path.  Without it, an Upstream registered before is dropped.
+	Upstream string
+}
+
+func (spec EntrySpec) validate() error {
+	if !strings.HasPrefix(spec.Path, "/") {
+		return errors.New("Path must start with a slash")
+	}
+	if spec.TTL < 0 || spec.MaxServedAge < 0 {
+		return errors.New("TTLs must not be negative")
+	}
+	if spec.TTL > 0 && spec.MaxServedAge > 0 && spec.MaxServedAge < spec.TTL {
+		return errors.New("Maximum served age must not be shorter than the TTL")
+	}
+	if spec.Upstream != "" && !strings.HasPrefix(spec.Upstream, "/") {
+		return errors.New("Upstream path must start with a slash")
+	}
+	return nil
+}
+
+type registerManyKeepMessage struct {
+	specs []EntrySpec
+	done  chan<- bool
+}
+
+func (k *Keep) sendRegisterManyKeepMessage(specs []EntrySpec, done chan<- bool) {
+	msg := registerManyKeepMessage{specs: specs, done: done}
+	k.messageChannel <- &msg
+}
+
+func (msg *registerManyKeepMessage) process(k *Keep) {
+	for _, spec := range msg.specs {
+		e, ok := k.entries[spec.Path]
+		if !ok {
+			// A zero LastFetched makes the entry expire right
+			// away, so it's fetched on the next pass.
+			e = &entry{info: EntryInfo{Path: spec.Path}}
+			k.entries[spec.Path] = e
+		}
+
+		e.info.Pinned = spec.Pinned
+		e.info.Cold = false
+		if spec.Labels != nil {
+			e.info.Labels = spec.Labels
+		}
+		e.info.SoftTTL = spec.TTL
+		e.info.MaxServedAge = spec.MaxServedAge
+		e.info.Immutable = spec.Immutable || k.matchesImmutable(spec.Path)
+		if e.info.Immutable {
+			atomic.StoreInt32(&k.hasImmutables, 1)
+		}
+		if spec.Upstream != "" {
+			k.upstreams.Store(spec.Path, spec.Upstream)
+		} else {
+			k.upstreams.Delete(spec.Path)
+		}
+		if e.info.Count < k.numExpiresToDecay {
+			e.info.Count = k.numExpiresToDecay
+		}
+		k.reschedule(e)
+	}
+	msg.done <- true
+}
+
+// RegisterMany adds the paths of specs to the keep with their settings,
+// all at once.  Settings of paths already in the keep are replaced.  It
+// returns an error for each spec, in order, which is nil if the path was
+// registered, and not nil if the spec was invalid.
+func (k *Keep) RegisterMany(specs []EntrySpec) []error {
+	errs := make([]error, len(specs))
+	var valid []EntrySpec
+	for i, spec := range specs {
+		errs[i] = spec.validate()
+		if errs[i] == nil {
+			valid = append(valid, spec)
+		}
+	}
+
+	done := make(chan bool, 1)
+	k.sendRegisterManyKeepMessage(valid, done)
+	<-done
+	return errs
+}
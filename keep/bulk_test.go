@@ -0,0 +1,45 @@
+package keep
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRegisterMany(t *testing.T) {
+	c := newTestCache()
+	k := newTestKeep(c, nil)
+
+	errs := k.RegisterMany([]EntrySpec{
+		{Path: "/a", TTL: time.Minute, MaxServedAge: time.Hour, Pinned: true, Labels: map[string]string{"team": "a"}},
+		{Path: "nope"},
+		{Path: "/b", Upstream: "b"},
+	})
+	if errs[0] != nil || errs[1] == nil || errs[2] == nil {
+		t.Errorf("got errors %v", errs)
+	}
+	ei, ok := entryInfo(k, "/a")
+	if !ok || !ei.Pinned || ei.SoftTTL != time.Minute || ei.MaxServedAge != time.Hour || ei.Labels["team"] != "a" {
+		t.Errorf("registered %+v", ei)
+	}
+	if k.Contains("/b") {
+		t.Error("registered an invalid spec")
+	}
+	eventually(t, "/a to be fetched", func() bool { return c.fetchCount("/a") == 1 })
+}
+
+func TestRegisterManyUpstream(t *testing.T) {
+	c := newTestCache()
+	k := newTestKeep(c, nil)
+
+	k.RegisterMany([]EntrySpec{{Path: "/a", Pinned: true, Upstream: "/upstream/a"}})
+	eventually(t, "the upstream path to be fetched", func() bool { return c.fetchCount("/upstream/a") == 1 })
+	eventually(t, "the fetch to finish", notFetching(k, "/a"))
+
+	// Without an upstream, the path itself is fetched again.
+	k.RegisterMany([]EntrySpec{{Path: "/a", Pinned: true}})
+	k.Refresh("/a")
+	eventually(t, "the path to be fetched", func() bool { return c.fetchCount("/a") == 1 })
+	if n := c.fetchCount("/upstream/a"); n != 1 {
+		t.Errorf("%d fetches of the old upstream path", n)
+	}
+}
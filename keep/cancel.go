@@ -0,0 +1,45 @@
+package keep
+
+import (
+	"context"
+	"io"
+)
+
+// A ContextCache can abandon a fetch from the upstream when ctx is
+// cancelled.
+type ContextCache interface {
+	FetchContext(ctx context.Context, path string) (io.ReadCloser, error)
+}
+
+func (k *Keep) fetchUpstream(ctx context.Context, path string) (io.ReadCloser, error) {
+	if k.hedgeDelay > 0 {
+		return k.hedgedFetch(ctx, path)
+	}
+	return k.fetchOnce(ctx, path)
+}
+
+func (k *Keep) fetchOnce(ctx context.Context, path string) (io.ReadCloser, error) {
+	cc, ok := k.cache.(ContextCache)
+	if !ok {
+		return k.cache.Fetch(path)
+	}
+	return cc.FetchContext(ctx, path)
+}
+
+// abandon cancels the background refresh of e, which nobody wants
+// anymore, if it's running and nobody is waiting for it.  The result
+// of a cancelled fetch is discarded.
+func (k *Keep) abandon(e *entry) {
+	if !e.abandonable() {
+		return
+	}
+	e.cancel()
+	e.cancelled = true
+	if k.debug {
+		k.debugf("REFRESH %s abandoned", e.info.Path)
+	}
+}
+
+func (e *entry) abandonable() bool {
+	return e.cancel != nil && !e.cancelled && len(e.waiters) == 0
+}
@@ -0,0 +1,61 @@
+package keep
+
+import (
+	"testing"
+	"time"
+)
+
+// waitWritten waits until the writes of path's fetches are done.
+func waitWritten(t *testing.T, k *Keep, path string) {
+	t.Helper()
+	if _, ok := k.WaitForToken(path, 1, 5*time.Second); !ok {
+		t.Fatalf("timed out waiting for the writes of %s", path)
+	}
+}
+
+func TestEvictedWhileRefreshing(t *testing.T) {
+	c := newTestCache()
+	k := newTestKeep(c, func(k *Keep) { k.SetMaxBytes(12, EvictLRU) })
+
+	c.setBody("/a", "aaaaaaaa")
+	c.setBody("/b", "bbbbbbbb")
+	if result := request(k, "/a"); result.err != nil {
+		t.Fatal(result.err)
+	}
+	eventually(t, "the fetch to finish", notFetching(k, "/a"))
+	waitWritten(t, k, "/a")
+	waitStarted(t, c, "/a")
+
+	c.hold("/a")
+	k.Refresh("/a")
+	waitStarted(t, c, "/a")
+
+	// Fetching /b goes over the budget, which evicts /a while it's
+	// being refreshed.
+	c.setBody("/a", "AAAAAAAA")
+	if result := request(k, "/b"); result.err != nil {
+		t.Fatal(result.err)
+	}
+	eventually(t, "/a to be evicted", func() bool {
+		_, ok := c.stored("/a")
+		return !ok
+	})
+
+	c.release("/a")
+	eventually(t, "the refresh to finish", notFetching(k, "/a"))
+	waitWritten(t, k, "/a")
+
+	if data, ok := c.stored("/a"); ok {
+		t.Errorf("the abandoned refresh cached %q", data)
+	}
+	if n := c.setCount("/a"); n != 1 {
+		t.Errorf("%d writes of /a, want 1", n)
+	}
+	ei, _ := entryInfo(k, "/a")
+	if ei.Size != 0 {
+		t.Errorf("evicted entry has size %d", ei.Size)
+	}
+	if data, ok := c.stored("/b"); !ok || data != "bbbbbbbb" {
+		t.Errorf("got %q for /b", data)
+	}
+}
@@ -0,0 +1,117 @@
+package keep
+
+import (
+	"errors"
+	"time"
+)
+
+// Config holds the settings of a keep that can be changed while it's
+// running.  The others, like the cache and its upstream, the goroutine
+// limit and the hedging limit, can only be set before Run.
+type Config struct {
+	// ExpireDuration is the time an entry takes to be refetched.
+	ExpireDuration time.Duration
+	// NumExpiresToDecay is the number of refetches it takes for the
+	// entry count to degrade by one.
+	NumExpiresToDecay int
+	MaxFetches        int
+	ValidateRefreshes bool
+	WaiterStrategy    WaiterStrategy
+	MaxWaiters        int
+	MaxBytes          int64
+	EvictionPolicy    EvictionPolicy
+}
+
+type configKeepMessage struct {
+	reply chan<- Config
+}
+
+type reconfigureKeepMessage struct {
+	cfg Config
+}
+
+func (k *Keep) sendConfigKeepMessage(reply chan<- Config) {
+	msg := configKeepMessage{reply: reply}
+	k.messageChannel <- &msg
+}
+
+func (k *Keep) sendReconfigureKeepMessage(cfg Config) {
+	msg := reconfigureKeepMessage{cfg: cfg}
+	k.messageChannel <- &msg
+}
+
+func (msg *configKeepMessage) process(k *Keep) {
+	msg.reply <- Config{ExpireDuration: k.expireDuration,
+		NumExpiresToDecay: k.numExpiresToDecay,
+		MaxFetches:        k.maxFetches,
+		ValidateRefreshes: k.validateRefreshes,
+		WaiterStrategy:    k.waiterStrategy,
+		MaxWaiters:        k.maxWaiters,
+		MaxBytes:          k.maxBytes,
+		EvictionPolicy:    k.evictionPolicy}
+}
+
+func (msg *reconfigureKeepMessage) process(k *Keep) {
+	cfg := msg.cfg
+
+	k.expireDuration = cfg.ExpireDuration
+	// An autotuned interval stays within its new bounds.
+	if k.maxRefreshInterval <= k.expireDuration || k.refreshInterval < k.expireDuration {
+		k.refreshInterval = k.expireDuration
+	}
+	k.numExpiresToDecay = cfg.NumExpiresToDecay
+	k.maxFetches = cfg.MaxFetches
+	k.validateRefreshes = cfg.ValidateRefreshes
+	k.waiterStrategy = cfg.WaiterStrategy
+	k.maxWaiters = cfg.MaxWaiters
+	k.maxBytes = cfg.MaxBytes
+	k.evictionPolicy = cfg.EvictionPolicy
+
+	k.evict(nil)
+	// Expire times and the fetch limit may have changed.
+	k.rescheduleAll()
+}
+
+func (cfg Config) validate() error {
+	if cfg.ExpireDuration <= 0 {
+		return errors.New("Expire duration must be positive")
+	}
+	if cfg.NumExpiresToDecay <= 0 {
+		return errors.New("Number of expires to decay must be positive")
+	}
+	if cfg.MaxFetches < 0 {
+		return errors.New("Maximum number of fetches must not be negative")
+	}
+	if cfg.WaiterStrategy == WaitersShed && cfg.MaxWaiters <= 0 {
+		return errors.New("Maximum number of waiters must be positive")
+	}
+	if cfg.WaiterStrategy < WaitersInLoop || cfg.WaiterStrategy > WaitersShed {
+		return errors.New("Unknown waiter strategy")
+	}
+	if cfg.MaxBytes < 0 {
+		return errors.New("Maximum number of bytes must not be negative")
+	}
+	if cfg.EvictionPolicy == nil {
+		return errors.New("Eviction policy is required")
+	}
+	return nil
+}
+
+// Config returns the current settings of the keep.
+func (k *Keep) Config() Config {
+	c := make(chan Config, 1)
+	k.sendConfigKeepMessage(c)
+	return <-c
+}
+
+// Reconfigure replaces the settings of the running keep with cfg, all
+// at once.  To change only some of them, modify what Config returns.
+// If cfg is invalid, it returns an error and nothing is changed.
+func (k *Keep) Reconfigure(cfg Config) error {
+	err := cfg.validate()
+	if err != nil {
+		return err
+	}
+	k.sendReconfigureKeepMessage(cfg)
+	return nil
+}
@@ -0,0 +1,40 @@
+package keep
+
+import (
+	"testing"
+)
+
+func TestEmptyBodyNoContent(t *testing.T) {
+	c := newTestCache()
+	c.setBody("/a", "")
+	k := newTestKeep(c, func(k *Keep) { k.SetEmptyBodyPolicy(EmptyBodyNoContent) })
+
+	if result := request(k, "/a"); result.err != nil || result.data != "" {
+		t.Errorf("got %+v", result)
+	}
+	waitWritten(t, k, "/a")
+	if data, ok := c.stored("/a"); !ok || data != "" {
+		t.Errorf("stored %q, %v", data, ok)
+	}
+}
+
+func TestEmptyBodyReject(t *testing.T) {
+	c := newTestCache()
+	c.setBody("/a", "")
+	k := newTestKeep(c, func(k *Keep) { k.SetEmptyBodyPolicy(EmptyBodyReject) })
+
+	if result := request(k, "/a"); result.err != ErrEmptyBody {
+		t.Errorf("got %+v", result)
+	}
+	if _, ok := c.stored("/a"); ok {
+		t.Error("cached an empty body")
+	}
+	if ei, _ := entryInfo(k, "/a"); ei.LastErr != ErrEmptyBody {
+		t.Errorf("entry has error %v", ei.LastErr)
+	}
+
+	// Non-empty bodies are unaffected.
+	if result := request(k, "/b"); result.err != nil || result.data != "data /b" {
+		t.Errorf("got %+v", result)
+	}
+}
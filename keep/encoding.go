@@ -0,0 +1,228 @@
+package keep
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// A VariantCache is a cache that can also fetch encoded variants of a
+// path from the upstream.
+type VariantCache interface {
+	Cache
+	// FetchEncoded fetches path, asking the upstream for encoding.
+	// It returns the body as sent, along with the encoding it's
+	// actually in.
+	FetchEncoded(path string, encoding string) (io.ReadCloser, string, error)
+}
+
+// The encodings variants can be stored in, besides identity.
+var variantEncodings = map[string]bool{
+	"gzip": true,
+	"zstd": true,
+}
+
+// VariantKey returns the cache key for the variant of path in
+// encoding.
+func VariantKey(path string, encoding string) string {
+	if encoding == "" || encoding == "identity" {
+		return path
+	}
+	return path + "#" + encoding
+}
+
+// SetEncodings makes the keep store variants of every path in the
+// given encodings, which can be gzip and zstd.  The variants are
+// fetched after the identity data, so they can briefly lag behind it.
+// The cache must be a VariantCache.  No variants are stored if there
+// are transforms.  It must be called before Run.
+func (k *Keep) SetEncodings(encodings []string) error {
+	if _, ok := k.cache.(VariantCache); !ok && len(encodings) > 0 {
+		return fmt.Errorf("Cache does not support encoded variants")
+	}
+	for _, encoding := range encodings {
+		if !variantEncodings[encoding] {
+			return fmt.Errorf("Unsupported encoding %s", encoding)
+		}
+	}
+	k.encodings = encodings
+	return nil
+}
+
+func (k *Keep) hasEncoding(encoding string) bool {
+	for _, e := range k.encodings {
+		if e == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultMaxVariants is the default maximum number of variants stored
+// per path.
+const DefaultMaxVariants = 4
+
+// SetMaxVariants sets the maximum number of variants stored per path,
+// besides identity.  Once a path has that many, a request for another
+// variant evicts the least recently requested one.  The default is
+// DefaultMaxVariants.  It must be called before Run.
+func (k *Keep) SetMaxVariants(n int) {
+	k.maxVariants = n
+}
+
+type variantsKeepMessage struct {
+	path  string
+	reply chan<- []string
+}
+
+type variantRequestedKeepMessage struct {
+	path     string
+	encoding string
+}
+
+func (k *Keep) sendVariantsKeepMessage(path string, reply chan<- []string) {
+	msg := variantsKeepMessage{path: path, reply: reply}
+	k.messageChannel <- &msg
+}
+
+func (k *Keep) sendVariantRequestedKeepMessage(path string, encoding string) {
+	msg := variantRequestedKeepMessage{path: path, encoding: encoding}
+	k.messageChannel <- &msg
+}
+
+// initialVariants returns the variants a path starts out with, before
+// any of them were requested.
+func (k *Keep) initialVariants() []string {
+	if len(k.encodings) > k.maxVariants {
+		return k.encodings[:k.maxVariants]
+	}
+	return k.encodings
+}
+
+func (k *Keep) initVariants(e *entry) {
+	if e.variants != nil {
+		return
+	}
+	e.variants = make(map[string]time.Time)
+	for _, encoding := range k.initialVariants() {
+		e.variants[encoding] = time.Time{}
+	}
+	e.info.Variants = len(e.variants)
+}
+
+func (msg *variantsKeepMessage) process(k *Keep) {
+	e, ok := k.entries[msg.path]
+	if !ok {
+		msg.reply <- k.initialVariants()
+		return
+	}
+	k.initVariants(e)
+	var encodings []string
+	for _, encoding := range k.encodings {
+		if _, ok := e.variants[encoding]; ok {
+			encodings = append(encodings, encoding)
+		}
+	}
+	msg.reply <- encodings
+}
+
+func (msg *variantRequestedKeepMessage) process(k *Keep) {
+	e, ok := k.entries[msg.path]
+	if !ok || !k.hasEncoding(msg.encoding) || k.maxVariants <= 0 {
+		return
+	}
+	k.initVariants(e)
+	_, stored := e.variants[msg.encoding]
+	e.variants[msg.encoding] = time.Now()
+	if stored || len(e.variants) <= k.maxVariants {
+		e.info.Variants = len(e.variants)
+		return
+	}
+
+	var lru string
+	for encoding, requested := range e.variants {
+		if encoding == msg.encoding {
+			continue
+		}
+		if lru == "" || requested.Before(e.variants[lru]) {
+			lru = encoding
+		}
+	}
+	delete(e.variants, lru)
+	e.info.Variants = len(e.variants)
+	key := VariantKey(msg.path, lru)
+	fmt.Printf("evicting variant %s\n", key)
+	k.spawner.spawn(func() { k.cache.Delete(key) })
+}
+
+// VariantRequested records that path was requested in encoding, which
+// keeps the variant from being evicted, or has it stored with the next
+// fetch.
+func (k *Keep) VariantRequested(path string, encoding string) {
+	k.sendVariantRequestedKeepMessage(path, encoding)
+}
+
+// variants returns the encodings of the variants stored for path.
+func (k *Keep) variants(path string) []string {
+	c := make(chan []string, 1)
+	k.sendVariantsKeepMessage(path, c)
+	return <-c
+}
+
+// fetchVariants fetches and stores the encoded variants of path.  The
+// checks of the identity body apply to them, too, except for
+// transforms, which can't be applied to encoded bodies: with transforms,
+// no variants are stored, because they would differ from the identity
+// data, whose ETag they're served with.
+func (k *Keep) fetchVariants(path string) {
+	vc := k.cache.(VariantCache)
+	for _, encoding := range k.variants(path) {
+		key := VariantKey(path, encoding)
+		if len(k.transforms) > 0 {
+			k.cache.Delete(key)
+			continue
+		}
+
+		resp, gotEncoding, err := vc.FetchEncoded(k.upstreamPath(path), encoding)
+		if err != nil {
+			fmt.Printf("variant fetch error\n")
+			k.cache.Delete(key)
+			continue
+		}
+		var contentLength int64 = -1
+		if rb, ok := resp.(ResponseBody); ok {
+			length, lengthErr := strconv.ParseInt(rb.Header().Get("Content-Length"), 10, 64)
+			if lengthErr == nil {
+				contentLength = length
+			}
+		}
+		buffer := new(bytes.Buffer)
+		var n int64
+		n, err = io.Copy(buffer, resp)
+		resp.Close()
+		if err == nil {
+			err = k.checkLength(n, contentLength)
+		}
+		// An encoding of data is never empty, and an empty identity
+		// body is served as such.
+		if err != nil || gotEncoding != encoding || n == 0 {
+			// Don't serve an outdated variant.
+			k.cache.Delete(key)
+			continue
+		}
+
+		err = k.setData(key, buffer.Bytes())
+		if err != nil {
+			fmt.Printf("cache set error\n")
+		}
+	}
+}
+
+func (k *Keep) deletePath(path string) {
+	k.cache.Delete(path)
+	for _, encoding := range k.encodings {
+		k.cache.Delete(VariantKey(path, encoding))
+	}
+}
@@ -0,0 +1,116 @@
+package keep
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// variantCache is a testCache whose upstream returns variants whose
+// bodies are the encoding in front of the identity body.
+type variantCache struct {
+	*testCache
+	mu sync.Mutex
+	// variantBodies overrides the bodies of variants, and
+	// variantLengths the Content-Lengths they come with.
+	variantBodies  map[string]string
+	variantLengths map[string]int
+}
+
+func newVariantCache() *variantCache {
+	return &variantCache{testCache: newTestCache(),
+		variantBodies:  make(map[string]string),
+		variantLengths: make(map[string]int)}
+}
+
+func (c *variantCache) FetchEncoded(path string, encoding string) (io.ReadCloser, string, error) {
+	c.testCache.mu.Lock()
+	body, ok := c.testCache.bodies[path]
+	c.testCache.mu.Unlock()
+	if !ok {
+		body = "data " + path
+	}
+	body = encoding + ":" + body
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := VariantKey(path, encoding)
+	if override, ok := c.variantBodies[key]; ok {
+		body = override
+	}
+	length := len(body)
+	if override, ok := c.variantLengths[key]; ok {
+		length = override
+	}
+	header := http.Header{"Content-Length": {strconv.Itoa(length)}}
+	return testBody{Reader: strings.NewReader(body), header: header}, encoding, nil
+}
+
+func fetchWithVariants(t *testing.T, c *variantCache, configure func(k *Keep), encodings ...string) *Keep {
+	t.Helper()
+	k := NewKeep(c, time.Hour, 5, 0)
+	if err := k.SetEncodings(encodings); err != nil {
+		t.Fatal(err)
+	}
+	if configure != nil {
+		configure(k)
+	}
+	go k.Run()
+	if result := request(k, "/a"); result.err != nil {
+		t.Fatal(result.err)
+	}
+	eventually(t, "the fetch to finish", notFetching(k, "/a"))
+	return k
+}
+
+func TestVariantsStored(t *testing.T) {
+	c := newVariantCache()
+	fetchWithVariants(t, c, nil, "gzip", "zstd")
+
+	for _, encoding := range []string{"gzip", "zstd"} {
+		eventually(t, "the "+encoding+" variant", func() bool {
+			data, ok := c.stored(VariantKey("/a", encoding))
+			return ok && data == encoding+":data /a"
+		})
+	}
+}
+
+func TestVariantsNotStoredWithTransforms(t *testing.T) {
+	c := newVariantCache()
+	// A variant from before the transform was added must go.
+	c.Set(VariantKey("/a", "gzip"), []byte("old"))
+	upper := func(path string, body []byte) ([]byte, error) {
+		return []byte(strings.ToUpper(string(body))), nil
+	}
+	fetchWithVariants(t, c, func(k *Keep) { k.AddTransform(upper) }, "gzip")
+
+	eventually(t, "the identity data", func() bool {
+		data, _ := c.stored("/a")
+		return data == "DATA /A"
+	})
+	eventually(t, "the old variant to be deleted", func() bool {
+		_, ok := c.stored(VariantKey("/a", "gzip"))
+		return !ok
+	})
+}
+
+func TestBadVariantsNotStored(t *testing.T) {
+	c := newVariantCache()
+	c.variantBodies[VariantKey("/a", "gzip")] = ""
+	c.variantLengths[VariantKey("/a", "zstd")] = 1000
+	k := fetchWithVariants(t, c, func(k *Keep) { k.SetCheckLengths(true) }, "gzip", "zstd")
+
+	// Token waiters wait for the write, which includes the variants.
+	if _, ok := k.WaitForToken("/a", 1, 5*time.Second); !ok {
+		t.Fatal("timed out waiting for the write")
+	}
+	for _, encoding := range []string{"gzip", "zstd"} {
+		if _, ok := c.stored(VariantKey("/a", encoding)); ok {
+			t.Errorf("stored a bad %s variant", encoding)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package keep
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+)
+
+// SetETagHash sets the hash the ETags of entries are computed with.
+// The default is SHA-256.  It must be called before Run.
+func (k *Keep) SetETagHash(newHash func() hash.Hash) {
+	k.newETagHash = newHash
+}
+
+// SetSkipUnchanged makes refreshes not write data to the cache if its
+// ETag hasn't changed.  The cache has to reliably keep what it's
+// given, or the data will be lost until the upstream changes it.  It
+// must be called before Run.
+func (k *Keep) SetSkipUnchanged(skip bool) {
+	k.skipUnchanged = skip
+}
+
+func (k *Keep) etagHash() hash.Hash {
+	if k.newETagHash == nil {
+		return sha256.New()
+	}
+	return k.newETagHash()
+}
+
+// computeETag returns the ETag for data.
+func (k *Keep) computeETag(data []byte) string {
+	h := k.etagHash()
+	h.Write(data)
+	return k.formatETag(h.Sum(nil))
+}
+
+// formatETag returns the ETag for a hash sum.  It's weak if there are
+// encodings, so that it can be used for all variants of the data.
+func (k *Keep) formatETag(sum []byte) string {
+	if len(sum) > 16 {
+		sum = sum[:16]
+	}
+	etag := `"` + hex.EncodeToString(sum) + `"`
+	if len(k.encodings) > 0 {
+		return "W/" + etag
+	}
+	return etag
+}
+
+type etagKeepMessage struct {
+	path  string
+	reply chan<- string
+}
+
+func (k *Keep) sendETagKeepMessage(path string, reply chan<- string) {
+	msg := etagKeepMessage{path: path, reply: reply}
+	k.messageChannel <- &msg
+}
+
+func (msg *etagKeepMessage) process(k *Keep) {
+	e, ok := k.entries[msg.path]
+	if !ok {
+		msg.reply <- ""
+		return
+	}
+	msg.reply <- e.etag
+}
+
+// ETag returns the ETag of the last data fetched for path, computed
+// from its identity encoding, or the empty string if there is none.
+func (k *Keep) ETag(path string) string {
+	c := make(chan string, 1)
+	k.sendETagKeepMessage(path, c)
+	return <-c
+}
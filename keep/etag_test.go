@@ -0,0 +1,77 @@
+package keep
+
+import (
+	"crypto/sha1"
+	"strings"
+	"testing"
+	"time"
+)
+
+// refresh refreshes path and waits until the refreshed data is written.
+func refresh(t *testing.T, k *Keep, path string) {
+	t.Helper()
+	token := k.Refresh(path)
+	if _, ok := k.WaitForToken(path, token, 5*time.Second); !ok {
+		t.Fatalf("timed out refreshing %s", path)
+	}
+	// The waiters get the data before it's written.
+	waitWritten(t, k, path)
+}
+
+func TestStableETag(t *testing.T) {
+	c := newTestCache()
+	k := newTestKeep(c, nil)
+
+	if err := k.Prime("/a"); err != nil {
+		t.Fatal(err)
+	}
+	waitWritten(t, k, "/a")
+	etag := k.ETag("/a")
+	if !strings.HasPrefix(etag, `"`) {
+		t.Errorf("got ETag %s, which isn't strong", etag)
+	}
+
+	refresh(t, k, "/a")
+	if k.ETag("/a") != etag {
+		t.Errorf("ETag changed from %s to %s for the same data", etag, k.ETag("/a"))
+	}
+	c.setBody("/a", "changed")
+	refresh(t, k, "/a")
+	if k.ETag("/a") == etag {
+		t.Error("ETag didn't change with the data")
+	}
+}
+
+func TestETagHash(t *testing.T) {
+	c := newTestCache()
+	k := newTestKeep(c, nil)
+	k1 := newTestKeep(c, func(k *Keep) { k.SetETagHash(sha1.New) })
+	for _, k := range []*Keep{k, k1} {
+		if err := k.Prime("/a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if k.ETag("/a") == k1.ETag("/a") {
+		t.Error("the hashes made the same ETag")
+	}
+}
+
+func TestSkipUnchanged(t *testing.T) {
+	c := newTestCache()
+	k := newTestKeep(c, func(k *Keep) { k.SetSkipUnchanged(true) })
+
+	if err := k.Prime("/a"); err != nil {
+		t.Fatal(err)
+	}
+	waitWritten(t, k, "/a")
+	refresh(t, k, "/a")
+	if n := c.setCount("/a"); n != 1 {
+		t.Errorf("%d writes of unchanged data", n)
+	}
+
+	c.setBody("/a", "changed")
+	refresh(t, k, "/a")
+	if data, _ := c.stored("/a"); data != "changed" || c.setCount("/a") != 2 {
+		t.Errorf("stored %q in %d writes", data, c.setCount("/a"))
+	}
+}
@@ -0,0 +1,148 @@
+package keep
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// An EvictionPolicy picks the entries to evict when the cache is over
+// its byte budget.
+type EvictionPolicy interface {
+	Name() string
+	// Less returns whether a should be evicted before b.
+	Less(a *EntryInfo, b *EntryInfo) bool
+}
+
+type lruPolicy struct{}
+
+func (lruPolicy) Name() string {
+	return "lru"
+}
+
+func (lruPolicy) Less(a *EntryInfo, b *EntryInfo) bool {
+	return a.LastRequested.Before(b.LastRequested)
+}
+
+type lfuPolicy struct{}
+
+func (lfuPolicy) Name() string {
+	return "lfu"
+}
+
+func (lfuPolicy) Less(a *EntryInfo, b *EntryInfo) bool {
+	return a.Count < b.Count
+}
+
+type sizePolicy struct{}
+
+func (sizePolicy) Name() string {
+	return "size"
+}
+
+func (sizePolicy) Less(a *EntryInfo, b *EntryInfo) bool {
+	return a.Size > b.Size
+}
+
+type costPolicy struct{}
+
+func (costPolicy) Name() string {
+	return "cost"
+}
+
+// costScore is how valuable it is to keep the data of ei, in the spirit
+// of GreedyDual-Size-Frequency: the more often it's requested and the
+// longer it takes to fetch, the more valuable it is, and the larger it
+// is and the longer ago it was requested, the less.
+func costScore(ei *EntryInfo, now time.Time) float64 {
+	cost := ei.LastDuration
+	if cost < time.Millisecond {
+		cost = time.Millisecond
+	}
+	age := now.Sub(ei.LastRequested).Seconds()
+	if age < 0 {
+		age = 0
+	}
+	return float64(ei.Weight+1) * cost.Seconds() / float64(ei.Size+1) / (1 + age)
+}
+
+func (costPolicy) Less(a *EntryInfo, b *EntryInfo) bool {
+	now := time.Now()
+	return costScore(a, now) < costScore(b, now)
+}
+
+var (
+	// EvictLRU evicts the least recently requested entries first.
+	EvictLRU EvictionPolicy = lruPolicy{}
+	// EvictLFU evicts the least requested entries first.
+	EvictLFU EvictionPolicy = lfuPolicy{}
+	// EvictLargest evicts the largest entries first, to free
+	// space with as few evictions as possible.
+	EvictLargest EvictionPolicy = sizePolicy{}
+	// EvictCost evicts the entries that are cheapest to lose first,
+	// combining their size, how often and how recently they were
+	// requested, and how long they take to fetch.
+	EvictCost EvictionPolicy = costPolicy{}
+)
+
+// SetMaxBytes sets the budget for the data of all entries.  When it's
+// exceeded, entries are evicted in the order of policy until it isn't
+// anymore.  Evicted entries are deleted from the cache and not
+// refreshed until they are requested again.  Pinned entries are never
+// evicted.  Zero, the default, means no budget.  It must be called
+// before Run.
+func (k *Keep) SetMaxBytes(max int64, policy EvictionPolicy) {
+	k.maxBytes = max
+	k.evictionPolicy = policy
+}
+
+// setSize records that e's data is now size bytes.
+func (k *Keep) setSize(e *entry, size int) {
+	k.totalBytes += int64(size - e.info.Size)
+	e.info.Size = size
+}
+
+// dropData deletes e's data from the cache.
+func (k *Keep) dropData(e *entry) {
+	k.deletePath(e.info.Path)
+	k.setSize(e, 0)
+}
+
+// evict evicts entries until the cache is within its budget.  It
+// doesn't evict except, whose data might still be written to the
+// cache.  Entries being refreshed in the background are evicted by
+// abandoning the refresh.
+func (k *Keep) evict(except *entry) {
+	if k.maxBytes <= 0 || k.totalBytes <= k.maxBytes {
+		return
+	}
+
+	var candidates []*entry
+	for _, e := range k.entries {
+		if e == except || e.info.Pinned || e.info.Size == 0 {
+			continue
+		}
+		if e.info.Fetching && !e.abandonable() {
+			continue
+		}
+		candidates = append(candidates, e)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return k.evictionPolicy.Less(&candidates[i].info, &candidates[j].info)
+	})
+
+	for _, e := range candidates {
+		if k.totalBytes <= k.maxBytes {
+			break
+		}
+		fmt.Printf("evicting %s\n", e.info.Path)
+		if k.debug {
+			k.debugf("EVICT %s, %d bytes, by %s policy", e.info.Path, e.info.Size, k.evictionPolicy.Name())
+		}
+		k.abandon(e)
+		k.dropData(e)
+		e.info.Count = 0
+		k.reschedule(e)
+		k.stats.Evictions++
+	}
+}
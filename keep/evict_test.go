@@ -0,0 +1,126 @@
+package keep
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fillOverBudget requests /small, /large and /medium, in that order,
+// which are 10, 50 and 20 bytes, into a keep with a budget of 70 bytes.
+func fillOverBudget(t *testing.T, policy EvictionPolicy) (*Keep, *testCache) {
+	t.Helper()
+	c := newTestCache()
+	sizes := map[string]int{"/small": 10, "/large": 50, "/medium": 20}
+	for path, size := range sizes {
+		c.setBody(path, strings.Repeat("x", size))
+	}
+	k := newTestKeep(c, func(k *Keep) { k.SetMaxBytes(70, policy) })
+	for _, path := range []string{"/small", "/large", "/medium"} {
+		if result := request(k, path); result.err != nil {
+			t.Fatal(result.err)
+		}
+		waitWritten(t, k, path)
+	}
+	eventually(t, "an eviction", func() bool { return k.Stats().Evictions > 0 })
+	return k, c
+}
+
+func TestEvictLargest(t *testing.T) {
+	k, c := fillOverBudget(t, EvictLargest)
+
+	stats := k.Stats()
+	if stats.EvictionPolicy != "size" || stats.Evictions != 1 || stats.Bytes != 30 {
+		t.Errorf("got %d evictions by %s, %d bytes", stats.Evictions, stats.EvictionPolicy, stats.Bytes)
+	}
+	if _, ok := c.stored("/large"); ok {
+		t.Error("didn't evict the largest entry")
+	}
+	for _, path := range []string{"/small", "/medium"} {
+		if _, ok := c.stored(path); !ok {
+			t.Errorf("evicted %s", path)
+		}
+	}
+}
+
+func TestEvictLRU(t *testing.T) {
+	k, c := fillOverBudget(t, EvictLRU)
+
+	stats := k.Stats()
+	if stats.EvictionPolicy != "lru" || stats.Evictions != 1 || stats.Bytes != 70 {
+		t.Errorf("got %d evictions by %s, %d bytes", stats.Evictions, stats.EvictionPolicy, stats.Bytes)
+	}
+	if _, ok := c.stored("/small"); ok {
+		t.Error("didn't evict the least recently requested entry")
+	}
+	if ei, _ := entryInfo(k, "/small"); ei.Size != 0 || ei.Count != 0 {
+		t.Errorf("evicted entry %+v", ei)
+	}
+}
+
+func TestPinnedNotEvicted(t *testing.T) {
+	c := newTestCache()
+	c.setBody("/pinned", strings.Repeat("x", 50))
+	c.setBody("/b", strings.Repeat("x", 50))
+	k := newTestKeep(c, func(k *Keep) { k.SetMaxBytes(70, EvictLargest) })
+
+	k.Register("/pinned")
+	waitWritten(t, k, "/pinned")
+	if result := request(k, "/b"); result.err != nil {
+		t.Fatal(result.err)
+	}
+	waitWritten(t, k, "/b")
+	if _, ok := c.stored("/pinned"); !ok {
+		t.Error("evicted a pinned entry")
+	}
+	if n := k.Stats().Evictions; n != 0 {
+		t.Errorf("%d evictions", n)
+	}
+}
+
+// BenchmarkEvictionHitRatio replays a trace of requests for keys with
+// Zipf-distributed popularity and varying sizes, under a budget of a
+// fifth of their bytes, and reports the share of requests served from
+// the cache under each policy.
+func BenchmarkEvictionHitRatio(b *testing.B) {
+	const n = 1000
+	sizes := make([]int, n)
+	total := 0
+	for i := range sizes {
+		sizes[i] = 100 + i*37%900
+		total += sizes[i]
+	}
+	for _, policy := range []EvictionPolicy{EvictLRU, EvictLFU, EvictLargest, EvictCost} {
+		b.Run(policy.Name(), func(b *testing.B) {
+			c := newTestCache()
+			for i, size := range sizes {
+				c.setBody(fmt.Sprintf("/%d", i), strings.Repeat("x", size))
+			}
+			k := newTestKeep(c, func(k *Keep) { k.SetMaxBytes(int64(total/5), policy) })
+			zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, n-1)
+			misses := make(map[string]int)
+			hits := 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				path := fmt.Sprintf("/%d", zipf.Uint64())
+				if _, err := c.Get(path); err == nil {
+					hits++
+					k.Hit(path)
+					k.PathRequested(path)
+					continue
+				}
+				if result := request(k, path); result.err != nil {
+					b.Fatal(result.err)
+				}
+				<-c.started
+				misses[path]++
+				if _, ok := k.WaitForToken(path, Token(misses[path]), 5*time.Second); !ok {
+					b.Fatalf("timed out waiting for the writes of %s", path)
+				}
+			}
+			b.ReportMetric(float64(hits)/float64(b.N), "hit-ratio")
+		})
+	}
+}
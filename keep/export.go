@@ -0,0 +1,138 @@
+package keep
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// The export header, followed by the format version.
+const exportMagic = "RCEX"
+const exportVersion = 1
+
+// The largest entry we're willing to read.
+const maxExportFrame = 1 << 30
+
+type exportRecord struct {
+	Entry    snapshotEntry
+	Body     []byte
+	Checksum uint32
+}
+
+// ErrExportVersion is returned by Import for exports in an unknown
+// format version.
+var ErrExportVersion = errors.New("Unknown export format version")
+
+// Export writes all entries along with their data in the cache to w.
+// Entries whose data is not in the cache are skipped.
+func (k *Keep) Export(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	_, err := bw.WriteString(exportMagic)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(bw, binary.BigEndian, uint32(exportVersion))
+	if err != nil {
+		return err
+	}
+
+	for _, ei := range k.Dump() {
+		body, err := k.cache.Get(ei.Path)
+		if err != nil {
+			continue
+		}
+
+		record := exportRecord{Entry: newSnapshotEntry(ei), Body: body, Checksum: crc32.ChecksumIEEE(body)}
+		frame := new(bytes.Buffer)
+		err = gob.NewEncoder(frame).Encode(&record)
+		if err != nil {
+			return err
+		}
+		err = binary.Write(bw, binary.BigEndian, uint32(frame.Len()))
+		if err != nil {
+			return err
+		}
+		_, err = bw.Write(frame.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Import adds the entries in an export written by Export to the keep,
+// and writes their data to the cache.  Their data is fresh for the rest
+// of its expire time.  Entries that are already in the keep are left
+// alone, data and all, and ones that can't be read are skipped.
+func (k *Keep) Import(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(exportMagic))
+	_, err := io.ReadFull(br, magic)
+	if err != nil {
+		return err
+	}
+	if string(magic) != exportMagic {
+		return errors.New("Not a keep export")
+	}
+	var version uint32
+	err = binary.Read(br, binary.BigEndian, &version)
+	if err != nil {
+		return err
+	}
+	if version != exportVersion {
+		return ErrExportVersion
+	}
+
+	var entries []snapshotEntry
+	var bodies [][]byte
+	for {
+		var length uint32
+		err = binary.Read(br, binary.BigEndian, &length)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if length > maxExportFrame {
+			return fmt.Errorf("Export entry too large: %d bytes", length)
+		}
+		frame := make([]byte, length)
+		_, err = io.ReadFull(br, frame)
+		if err != nil {
+			return err
+		}
+
+		var record exportRecord
+		err = gob.NewDecoder(bytes.NewReader(frame)).Decode(&record)
+		if err != nil || crc32.ChecksumIEEE(record.Body) != record.Checksum {
+			fmt.Printf("skipping unreadable export entry\n")
+			continue
+		}
+
+		entries = append(entries, record.Entry)
+		bodies = append(bodies, record.Body)
+	}
+
+	// Only the data of the entries that were restored is written,
+	// so that the data of the ones already in the keep isn't
+	// replaced by older data.
+	restored := make(chan []bool, 1)
+	k.sendRestoreKeepMessage(entries, bodies, restored)
+	for i, ok := range <-restored {
+		if !ok {
+			continue
+		}
+		err = k.cache.Set(entries[i].Path, bodies[i])
+		if err != nil {
+			fmt.Printf("cache set error\n")
+			k.sendDontReloadKeepMessage(entries[i].Path, true)
+		}
+	}
+	return nil
+}
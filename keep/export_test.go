@@ -0,0 +1,64 @@
+package keep
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	c := newTestCache()
+	k := newTestKeep(c, nil)
+	c.setBody("/a", "old a")
+	for _, path := range []string{"/a", "/b"} {
+		if err := k.Prime(path); err != nil {
+			t.Fatal(err)
+		}
+		waitWritten(t, k, path)
+	}
+	exported := new(bytes.Buffer)
+	if err := k.Export(exported); err != nil {
+		t.Fatal(err)
+	}
+
+	// /a is already in the other keep, with newer data.
+	other := newTestCache()
+	k2 := newTestKeep(other, nil)
+	other.setBody("/a", "new a")
+	if err := k2.Prime("/a"); err != nil {
+		t.Fatal(err)
+	}
+	waitWritten(t, k2, "/a")
+
+	if err := k2.Import(exported); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := other.stored("/a"); data != "new a" {
+		t.Errorf("import replaced the data of a kept entry with %q", data)
+	}
+	if n := other.setCount("/a"); n != 1 {
+		t.Errorf("%d writes of the kept entry", n)
+	}
+	if data, _ := other.stored("/b"); data != "data /b" {
+		t.Errorf("imported %q", data)
+	}
+	ei, ok := entryInfo(k2, "/b")
+	if !ok || ei.Size != len("data /b") {
+		t.Errorf("imported entry %+v", ei)
+	}
+	if k2.ETag("/b") != k.ETag("/b") {
+		t.Errorf("imported ETag %s, want %s", k2.ETag("/b"), k.ETag("/b"))
+	}
+	if n := other.fetchCount("/b"); n != 0 {
+		t.Errorf("%d fetches of the imported entry", n)
+	}
+}
+
+func TestImportBadExport(t *testing.T) {
+	k := newTestKeep(newTestCache(), nil)
+	if err := k.Import(bytes.NewReader([]byte("nope"))); err == nil {
+		t.Error("imported something that's not an export")
+	}
+	if err := k.Import(bytes.NewReader([]byte(exportMagic + "\x00\x00\x00\x07"))); err != ErrExportVersion {
+		t.Errorf("got %v for an unknown version", err)
+	}
+}
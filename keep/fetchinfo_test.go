@@ -0,0 +1,62 @@
+package keep
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// fetchHook collects the infos of fetches, for SetOnFetch.
+type fetchHook chan FetchInfo
+
+func (h fetchHook) onFetch(info FetchInfo) {
+	h <- info
+}
+
+func (h fetchHook) next(t *testing.T) FetchInfo {
+	t.Helper()
+	select {
+	case info := <-h:
+		return info
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a fetch")
+	}
+	return FetchInfo{}
+}
+
+func TestFetchInfo(t *testing.T) {
+	c := newTestCache()
+	c.setHeader("/a", http.Header{"Content-Type": {"application/json"}})
+	c.setErr("/b", errors.New("upstream down"))
+	hook := make(fetchHook, 10)
+	k := newTestKeep(c, func(k *Keep) { k.SetOnFetch(hook.onFetch) })
+
+	request(k, "/a")
+	info := hook.next(t)
+	if info.Path != "/a" || string(info.Data) != "data /a" || info.ContentType != "application/json" ||
+		info.Status != http.StatusOK || info.Err != nil || !info.Cached || info.FromCache || info.Duration <= 0 {
+		t.Errorf("got %+v", info)
+	}
+
+	request(k, "/b")
+	info = hook.next(t)
+	if info.Path != "/b" || info.Err == nil || info.Data != nil || info.Cached {
+		t.Errorf("got %+v for a failed fetch", info)
+	}
+}
+
+func TestFetchInfoNotCached(t *testing.T) {
+	c := newTestCache()
+	hook := make(fetchHook, 10)
+	k := NewKeep(c, time.Hour, 5, time.Hour)
+	k.SetOnFetch(hook.onFetch)
+	go k.Run()
+
+	if result := request(k, "/a"); result.data != "data /a" {
+		t.Errorf("got %+v", result)
+	}
+	if info := hook.next(t); info.Cached || info.Err != nil {
+		t.Errorf("got %+v for a fetch under the threshold", info)
+	}
+}
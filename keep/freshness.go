@@ -0,0 +1,201 @@
+package keep
+
+import (
+	"math"
+	"time"
+)
+
+type staleness struct {
+	expiredBy  time.Duration
+	overMaxAge bool
+}
+
+type stalenessKeepMessage struct {
+	path  string
+	reply chan<- staleness
+}
+
+type maxServedAgeKeepMessage struct {
+	path   string
+	maxAge time.Duration
+}
+
+type refreshKeepMessage struct {
+	path string
+	// invalidate is whether a running fetch is too old, so that
+	// another one is needed after it.
+	invalidate bool
+	reply      chan<- Token
+}
+
+type failingKeepMessage struct {
+	path  string
+	reply chan<- bool
+}
+
+type freshnessKeepMessage struct {
+	reply chan<- []float64
+}
+
+func (k *Keep) sendStalenessKeepMessage(path string, reply chan<- staleness) {
+	msg := stalenessKeepMessage{path: path, reply: reply}
+	k.messageChannel <- &msg
+}
+
+func (k *Keep) sendMaxServedAgeKeepMessage(path string, maxAge time.Duration) {
+	msg := maxServedAgeKeepMessage{path: path, maxAge: maxAge}
+	k.messageChannel <- &msg
+}
+
+func (k *Keep) sendRefreshKeepMessage(path string, invalidate bool, reply chan<- Token) {
+	msg := refreshKeepMessage{path: path, invalidate: invalidate, reply: reply}
+	k.messageChannel <- &msg
+}
+
+func (k *Keep) sendFailingKeepMessage(path string, reply chan<- bool) {
+	msg := failingKeepMessage{path: path, reply: reply}
+	k.messageChannel <- &msg
+}
+
+func (k *Keep) sendFreshnessKeepMessage(reply chan<- []float64) {
+	msg := freshnessKeepMessage{reply: reply}
+	k.messageChannel <- &msg
+}
+
+func (msg *stalenessKeepMessage) process(k *Keep) {
+	e, ok := k.entries[msg.path]
+	if !ok || e.info.LastFetched.IsZero() {
+		msg.reply <- staleness{}
+		return
+	}
+	if e.settled() {
+		msg.reply <- staleness{expiredBy: math.MinInt64}
+		return
+	}
+	now := time.Now()
+	msg.reply <- staleness{expiredBy: now.Sub(k.expireTime(e.info)),
+		overMaxAge: e.info.MaxServedAge > 0 && now.Sub(e.info.LastFetched) > e.info.MaxServedAge}
+}
+
+func (msg *failingKeepMessage) process(k *Keep) {
+	e, ok := k.entries[msg.path]
+	msg.reply <- ok && e.info.LastErr != nil
+}
+
+func (msg *maxServedAgeKeepMessage) process(k *Keep) {
+	e, ok := k.entries[msg.path]
+	if !ok {
+		return
+	}
+	e.info.MaxServedAge = msg.maxAge
+}
+
+func (msg *refreshKeepMessage) process(k *Keep) {
+	e, ok := k.entries[msg.path]
+	if !ok {
+		msg.reply <- 0
+		return
+	}
+	if e.info.Fetching {
+		if !msg.invalidate {
+			// The running fetch is the refresh.
+			msg.reply <- Token(e.fetches + 1)
+			return
+		}
+		// The running fetch might have started before whatever
+		// made the data stale, so it takes another one.
+		e.refreshPending = true
+		msg.reply <- Token(e.fetches + 2)
+		return
+	}
+	e.info.LastFetched = time.Time{}
+	k.reschedule(e)
+	msg.reply <- Token(e.fetches + 1)
+}
+
+// Staleness returns how long ago the data for path expired, and whether
+// it's older than the path's maximum served age.  The duration is
+// negative if the data has not expired yet, and zero if the path is not
+// in the keep.
+func (k *Keep) Staleness(path string) (expiredBy time.Duration, overMaxAge bool) {
+	c := make(chan staleness, 1)
+	k.sendStalenessKeepMessage(path, c)
+	s := <-c
+	return s.expiredBy, s.overMaxAge
+}
+
+// ExpiredBy returns how long ago the data for path expired, like
+// Staleness.
+func (k *Keep) ExpiredBy(path string) time.Duration {
+	expiredBy, _ := k.Staleness(path)
+	return expiredBy
+}
+
+// Failing returns whether the last fetch of path failed, so that its
+// data is stale because it couldn't be refreshed.
+func (k *Keep) Failing(path string) bool {
+	c := make(chan bool, 1)
+	k.sendFailingKeepMessage(path, c)
+	return <-c
+}
+
+// SetMaxServedAge sets the maximum age of data for path to be served,
+// independent of when it's refreshed.  Older data has to be fetched
+// before serving it, which Staleness reports.  Zero means no maximum.
+// It does nothing if the path is not in the keep.
+func (k *Keep) SetMaxServedAge(path string, maxAge time.Duration) {
+	k.sendMaxServedAgeKeepMessage(path, maxAge)
+}
+
+// Refresh makes the keep refetch path on its next pass, instead of
+// when its data expires.  If the path is being fetched, it's refetched
+// once that's done.  It returns a token for WaitForToken to wait for
+// the refetch with, which is zero if the path is not in the keep.
+func (k *Keep) Refresh(path string) Token {
+	c := make(chan Token, 1)
+	k.sendRefreshKeepMessage(path, true, c)
+	return <-c
+}
+
+// RefreshStale makes the keep refetch path on its next pass, like
+// Refresh, for serving data that has expired.  If the path is being
+// fetched already, that fetch refreshes it, so it does nothing.
+func (k *Keep) RefreshStale(path string) {
+	c := make(chan Token, 1)
+	k.sendRefreshKeepMessage(path, false, c)
+	<-c
+}
+
+func (msg *freshnessKeepMessage) process(k *Keep) {
+	now := time.Now()
+	ages := make([]float64, 0, len(k.entries))
+	for _, e := range k.entries {
+		if e.info.Count <= 0 || e.info.LastFetched.IsZero() || e.settled() {
+			continue
+		}
+		ttl := k.expireTime(e.info).Sub(e.info.LastFetched)
+		if ttl <= 0 {
+			continue
+		}
+		ages = append(ages, float64(now.Sub(e.info.LastFetched))/float64(ttl))
+	}
+	msg.reply <- ages
+}
+
+// FreshnessBounds are the bucket bounds of Freshness.
+var FreshnessBounds = []float64{0.25, 0.5, 0.75, 1, 1.5, 2, 4}
+
+// Freshness returns the distribution of the ages of the data of all
+// entries, as fractions of the time after which they're refetched.  A
+// value of 0.5 is an entry half way to its refetch, and values above 1
+// are entries overdue.
+func (k *Keep) Freshness() Histogram {
+	c := make(chan []float64, 1)
+	k.sendFreshnessKeepMessage(c)
+
+	h := newHistogram(FreshnessBounds)
+	for _, age := range <-c {
+		h.observe(age)
+	}
+	return h
+}
@@ -0,0 +1,32 @@
+package keep
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaxServedAge(t *testing.T) {
+	c := newTestCache()
+	k := newTestKeep(c, nil)
+
+	if err := k.Prime("/a"); err != nil {
+		t.Fatal(err)
+	}
+	k.SetMaxServedAge("/a", 200*time.Millisecond)
+	if expiredBy, overMaxAge := k.Staleness("/a"); overMaxAge || expiredBy >= 0 {
+		t.Errorf("fresh data is expired by %s, over its maximum age: %v", expiredBy, overMaxAge)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if expiredBy, overMaxAge := k.Staleness("/a"); !overMaxAge || expiredBy >= 0 {
+		t.Errorf("old data is expired by %s, over its maximum age: %v", expiredBy, overMaxAge)
+	}
+
+	// Other paths are unaffected.
+	if err := k.Prime("/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, overMaxAge := k.Staleness("/b"); overMaxAge {
+		t.Error("a path without a maximum age is over it")
+	}
+}
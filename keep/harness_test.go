@@ -0,0 +1,401 @@
+package keep
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCache is a Cache backed by a map, with an upstream whose fetches
+// can be held until the test releases them.
+type testCache struct {
+	mu      sync.Mutex
+	data    map[string][]byte
+	bodies  map[string]string
+	headers map[string]http.Header
+	errs    map[string]error
+	fetches map[string]int
+	sets    map[string]int
+	// Fetches of paths with a gate block until it's closed.
+	gates map[string]chan struct{}
+	// started gets the path of every fetch once it has started.
+	started chan string
+}
+
+func newTestCache() *testCache {
+	return &testCache{data: make(map[string][]byte),
+		bodies:  make(map[string]string),
+		headers: make(map[string]http.Header),
+		errs:    make(map[string]error),
+		fetches: make(map[string]int),
+		sets:    make(map[string]int),
+		gates:   make(map[string]chan struct{}),
+		started: make(chan string, 1000)}
+}
+
+// hold makes fetches of path block until release is called.
+func (c *testCache) hold(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gates[path] = make(chan struct{})
+}
+
+func (c *testCache) release(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gate, ok := c.gates[path]; ok {
+		close(gate)
+		delete(c.gates, path)
+	}
+}
+
+func (c *testCache) setBody(path string, body string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bodies[path] = body
+}
+
+func (c *testCache) setHeader(path string, header http.Header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.headers[path] = header
+}
+
+func (c *testCache) setErr(path string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errs[path] = err
+}
+
+func (c *testCache) fetchCount(path string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fetches[path]
+}
+
+func (c *testCache) setCount(path string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sets[path]
+}
+
+func (c *testCache) stored(path string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.data[path]
+	return string(data), ok
+}
+
+type testBody struct {
+	io.Reader
+	header http.Header
+}
+
+func (b testBody) Close() error {
+	return nil
+}
+
+func (b testBody) StatusCode() int {
+	return http.StatusOK
+}
+
+func (b testBody) Header() http.Header {
+	return b.header
+}
+
+func (c *testCache) Fetch(path string) (io.ReadCloser, error) {
+	c.mu.Lock()
+	c.fetches[path]++
+	gate := c.gates[path]
+	c.mu.Unlock()
+	c.started <- path
+	if gate != nil {
+		<-gate
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.errs[path]; err != nil {
+		return nil, err
+	}
+	body, ok := c.bodies[path]
+	if !ok {
+		body = "data " + path
+	}
+	header := c.headers[path]
+	if header == nil {
+		header = make(http.Header)
+	}
+	return testBody{Reader: strings.NewReader(body), header: header}, nil
+}
+
+func (c *testCache) Get(path string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.data[path]
+	if !ok {
+		return nil, errors.New("not in cache")
+	}
+	return data, nil
+}
+
+func (c *testCache) Set(path string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data[path] = append([]byte(nil), data...)
+	c.sets[path]++
+	return nil
+}
+
+func (c *testCache) Delete(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.data, path)
+	return nil
+}
+
+// newTestKeep returns a keep for c that refetches after an hour, after
+// calling configure on it, and runs it.
+func newTestKeep(c Cache, configure func(k *Keep)) *Keep {
+	k := NewKeep(c, time.Hour, 5, 0)
+	if configure != nil {
+		configure(k)
+	}
+	go k.Run()
+	return k
+}
+
+// requestResult is what a request got, as a handler would serve it.
+type requestResult struct {
+	data string
+	err  error
+}
+
+// request requests path the way the handler does on a cache miss.
+func request(k *Keep, path string) requestResult {
+	k.PathRequested(path)
+	buffer := new(bytes.Buffer)
+	data, err := k.WaitOrFetch(path, func(w io.Writer) io.Writer { return io.MultiWriter(buffer, w) })
+	if err != nil {
+		return requestResult{err: err}
+	}
+	if data == nil {
+		data = buffer.Bytes()
+	}
+	return requestResult{data: string(data)}
+}
+
+// startRequests starts n concurrent requests for path.  The first one
+// fetches, and the test can wait with waiters for the others to
+// coalesce on it.
+func startRequests(k *Keep, path string, n int) []chan requestResult {
+	results := make([]chan requestResult, n)
+	for i := range results {
+		results[i] = make(chan requestResult, 1)
+		go func(c chan requestResult) { c <- request(k, path) }(results[i])
+	}
+	return results
+}
+
+// waiterHook makes a keep report when requests start waiting, for
+// SetOnWaiter.
+type waiterHook struct {
+	waiters chan int
+}
+
+func newWaiterHook() *waiterHook {
+	return &waiterHook{waiters: make(chan int, 1000)}
+}
+
+func (h *waiterHook) onWaiter(path string, waiters int) {
+	h.waiters <- waiters
+}
+
+// wait waits until n requests are waiting for a fetch.
+func (h *waiterHook) wait(t *testing.T, n int) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case waiters := <-h.waiters:
+			if waiters >= n {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %d waiters", n)
+		}
+	}
+}
+
+// waitStarted waits for a fetch of path to start.
+func waitStarted(t *testing.T, c *testCache, path string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case started := <-c.started:
+			if started == path {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for a fetch of %s", path)
+		}
+	}
+}
+
+func collect(t *testing.T, results []chan requestResult) []requestResult {
+	t.Helper()
+	var collected []requestResult
+	for _, c := range results {
+		select {
+		case result := <-c:
+			collected = append(collected, result)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for a request")
+		}
+	}
+	return collected
+}
+
+// eventually waits for cond to hold.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// entryInfo returns the info of the entry for path.
+func entryInfo(k *Keep, path string) (EntryInfo, bool) {
+	for _, ei := range k.Dump() {
+		if ei.Path == path {
+			return ei, true
+		}
+	}
+	return EntryInfo{}, false
+}
+
+// notFetching returns whether path is in the keep and not being
+// fetched, for eventually.
+func notFetching(k *Keep, path string) func() bool {
+	return func() bool {
+		ei, ok := entryInfo(k, path)
+		return ok && !ei.Fetching
+	}
+}
+
+func TestCoalescedRequests(t *testing.T) {
+	c := newTestCache()
+	hook := newWaiterHook()
+	k := newTestKeep(c, func(k *Keep) { k.SetOnWaiter(hook.onWaiter) })
+
+	c.hold("/a")
+	results := startRequests(k, "/a", 5)
+	hook.wait(t, 4)
+	c.release("/a")
+
+	for i, result := range collect(t, results) {
+		if result.err != nil || result.data != "data /a" {
+			t.Errorf("request %d got %q, %v", i, result.data, result.err)
+		}
+	}
+	if n := c.fetchCount("/a"); n != 1 {
+		t.Errorf("%d upstream fetches, want 1", n)
+	}
+}
+
+func TestFailedFetchFailsWaiters(t *testing.T) {
+	c := newTestCache()
+	hook := newWaiterHook()
+	k := newTestKeep(c, func(k *Keep) { k.SetOnWaiter(hook.onWaiter) })
+	upstreamErr := errors.New("upstream down")
+	c.setErr("/a", upstreamErr)
+
+	c.hold("/a")
+	results := startRequests(k, "/a", 3)
+	hook.wait(t, 2)
+	c.release("/a")
+
+	for i, result := range collect(t, results) {
+		if result.err != upstreamErr {
+			t.Errorf("request %d got %q, %v, want the upstream error", i, result.data, result.err)
+		}
+	}
+	if n := c.fetchCount("/a"); n != 1 {
+		t.Errorf("%d upstream fetches, want 1", n)
+	}
+}
+
+func TestGoneWaiterDoesntBlock(t *testing.T) {
+	c := newTestCache()
+	hook := newWaiterHook()
+	k := newTestKeep(c, func(k *Keep) { k.SetOnWaiter(hook.onWaiter) })
+
+	c.hold("/a")
+	results := startRequests(k, "/a", 1)
+	waitStarted(t, c, "/a")
+	// A waiter that's gone before the result is handed to it, with a
+	// channel like that of tryLookup, and a request behind it.
+	k.sendFetchingMessage("/a", make(chan fetchResult, 1))
+	hook.wait(t, 1)
+	results = append(results, startRequests(k, "/a", 1)...)
+	hook.wait(t, 2)
+	c.release("/a")
+
+	for i, result := range collect(t, results) {
+		if result.err != nil || result.data != "data /a" {
+			t.Errorf("request %d got %q, %v", i, result.data, result.err)
+		}
+	}
+	if result := collect(t, startRequests(k, "/b", 1))[0]; result.err != nil {
+		t.Errorf("the loop is stuck: %v", result.err)
+	}
+}
+
+func TestColdRequestIsCached(t *testing.T) {
+	c := newTestCache()
+	k := newTestKeep(c, nil)
+
+	result := request(k, "/a")
+	if result.err != nil || result.data != "data /a" {
+		t.Fatalf("got %q, %v", result.data, result.err)
+	}
+	eventually(t, "the data to be cached", func() bool {
+		_, ok := c.stored("/a")
+		return ok
+	})
+	eventually(t, "the fetch to finish", notFetching(k, "/a"))
+
+	// The next request would be served from the cache by the
+	// handler, and doesn't make another fetch.
+	if n := c.fetchCount("/a"); n != 1 {
+		t.Errorf("%d upstream fetches, want 1", n)
+	}
+}
+
+func TestWaitersAfterFetchGetNewFetch(t *testing.T) {
+	c := newTestCache()
+	k := newTestKeep(c, nil)
+
+	for i := 0; i < 3; i++ {
+		c.setBody("/a", fmt.Sprintf("v%d", i))
+		eventually(t, "the fetch to finish", func() bool {
+			ei, ok := entryInfo(k, "/a")
+			return !ok || !ei.Fetching
+		})
+		result := request(k, "/a")
+		if result.err != nil || result.data != fmt.Sprintf("v%d", i) {
+			t.Fatalf("request %d got %q, %v", i, result.data, result.err)
+		}
+	}
+}
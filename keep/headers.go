@@ -0,0 +1,107 @@
+package keep
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// A ResponseBody is a fetched body that knows the response it came
+// with.  Fetch can return one to have headers replayed.
+type ResponseBody interface {
+	io.ReadCloser
+	StatusCode() int
+	Header() http.Header
+}
+
+// defaultStrippedHeaders are never replayed by default, because they
+// are specific to a connection, a client, or the encoding of the data.
+var defaultStrippedHeaders = []string{
+	"Content-Encoding",
+	"Content-Length",
+	"Set-Cookie",
+	"Set-Cookie2",
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func headerSet(names []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, name := range names {
+		set[http.CanonicalHeaderKey(name)] = true
+	}
+	return set
+}
+
+// SetReplayHeaders makes the keep store the given upstream headers with
+// the data, to be replayed with Header.  Fetch must return a
+// ResponseBody.  Stripped headers are never stored, even if they're
+// given here.  It must be called before Run.
+func (k *Keep) SetReplayHeaders(names []string) {
+	k.replayHeaders = headerSet(names)
+}
+
+// SetStrippedHeaders sets the headers that are never replayed.  The
+// default is Set-Cookie, Set-Cookie2, Content-Encoding, Content-Length
+// and the hop-by-hop headers.  It must be called before Run.
+func (k *Keep) SetStrippedHeaders(names []string) {
+	k.strippedHeaders = headerSet(names)
+}
+
+// replayedHeader returns the headers in header that are to be replayed.
+func (k *Keep) replayedHeader(header http.Header) http.Header {
+	replayed := make(http.Header)
+	for name, values := range header {
+		name = http.CanonicalHeaderKey(name)
+		if k.replayHeaders[name] && !k.strippedHeaders[name] {
+			replayed[name] = values
+		}
+	}
+	return replayed
+}
+
+type headerKeepMessage struct {
+	path  string
+	reply chan<- http.Header
+}
+
+func (k *Keep) sendHeaderKeepMessage(path string, reply chan<- http.Header) {
+	msg := headerKeepMessage{path: path, reply: reply}
+	k.messageChannel <- &msg
+}
+
+func (msg *headerKeepMessage) process(k *Keep) {
+	e, ok := k.entries[msg.path]
+	if !ok {
+		msg.reply <- nil
+		return
+	}
+	if e.settled() {
+		header := http.Header{}
+		for name, values := range e.header {
+			header[name] = values
+		}
+		header.Set("Cache-Control", ImmutableCacheControl)
+		msg.reply <- header
+		return
+	}
+	msg.reply <- e.header
+}
+
+// Header returns the headers stored with the last data fetched for
+// path, or nil if none are, plus a Cache-Control header for immutable
+// entries.  It must not be modified.
+func (k *Keep) Header(path string) http.Header {
+	if len(k.replayHeaders) == 0 && atomic.LoadInt32(&k.hasImmutables) == 0 {
+		return nil
+	}
+	c := make(chan http.Header, 1)
+	k.sendHeaderKeepMessage(path, c)
+	return <-c
+}
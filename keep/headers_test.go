@@ -0,0 +1,57 @@
+package keep
+
+import (
+	"net/http"
+	"testing"
+)
+
+func upstreamHeader() http.Header {
+	header := make(http.Header)
+	header.Set("Set-Cookie", "session=secret")
+	header.Set("X-Version", "7")
+	header.Set("Connection", "close")
+	header.Set("Content-Length", "7")
+	return header
+}
+
+func TestSetCookieNeverReplayed(t *testing.T) {
+	c := newTestCache()
+	c.setHeader("/a", upstreamHeader())
+	k := newTestKeep(c, func(k *Keep) {
+		k.SetReplayHeaders([]string{"set-cookie", "x-version", "Connection", "Content-Length"})
+	})
+
+	if result := request(k, "/a"); result.err != nil {
+		t.Fatal(result.err)
+	}
+	header := k.Header("/a")
+	if header.Get("X-Version") != "7" {
+		t.Errorf("didn't replay an allowed header: %v", header)
+	}
+	for _, name := range []string{"Set-Cookie", "Connection", "Content-Length"} {
+		if _, ok := header[name]; ok {
+			t.Errorf("replayed %s", name)
+		}
+	}
+}
+
+func TestStrippedHeaders(t *testing.T) {
+	c := newTestCache()
+	c.setHeader("/a", upstreamHeader())
+	k := newTestKeep(c, func(k *Keep) {
+		k.SetReplayHeaders([]string{"X-Version", "Set-Cookie"})
+		k.SetStrippedHeaders([]string{"x-version"})
+	})
+
+	if result := request(k, "/a"); result.err != nil {
+		t.Fatal(result.err)
+	}
+	header := k.Header("/a")
+	if _, ok := header["X-Version"]; ok {
+		t.Error("replayed a stripped header")
+	}
+	// The configured list replaces the default one.
+	if header.Get("Set-Cookie") != "session=secret" {
+		t.Errorf("got %v", header)
+	}
+}
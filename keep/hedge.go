@@ -0,0 +1,104 @@
+package keep
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// SetHedging makes a fetch that the upstream hasn't responded to after
+// delay send a second, hedged request, and take the response that
+// comes first.  The other request is cancelled if the cache is a
+// ContextCache.  At most maxHedges hedged requests run at a time, so
+// that a slow upstream doesn't get twice the load.  A fetch that fails
+// before the delay is not hedged.  Zero delay, the default, disables
+// hedging.  It must be called before Run.
+func (k *Keep) SetHedging(delay time.Duration, maxHedges int) {
+	k.hedgeDelay = delay
+	k.maxHedges = int32(maxHedges)
+}
+
+type hedgeAttempt struct {
+	index int
+	body  io.ReadCloser
+	err   error
+}
+
+// startHedge reserves one of the hedged requests, if there's one left.
+func (k *Keep) startHedge() bool {
+	if atomic.AddInt32(&k.hedging, 1) > k.maxHedges {
+		atomic.AddInt32(&k.hedging, -1)
+		return false
+	}
+	atomic.AddInt64(&k.hedges, 1)
+	return true
+}
+
+// hedgedFetch fetches path from the upstream, hedging as set by
+// SetHedging.  The context of the request that wins is only cancelled
+// with ctx, because cancelling it would abort reading its body.
+func (k *Keep) hedgedFetch(ctx context.Context, path string) (io.ReadCloser, error) {
+	results := make(chan hedgeAttempt, 2)
+	var cancels []context.CancelFunc
+	start := func() {
+		index := len(cancels)
+		attemptCtx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, cancel)
+		go func() {
+			body, err := k.fetchOnce(attemptCtx, path)
+			if index > 0 {
+				atomic.AddInt32(&k.hedging, -1)
+			}
+			results <- hedgeAttempt{index: index, body: body, err: err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(k.hedgeDelay)
+	defer timer.Stop()
+	timerChannel := timer.C
+	pending := 1
+	var result hedgeAttempt
+	for {
+		select {
+		case <-timerChannel:
+			timerChannel = nil
+			if k.startHedge() {
+				fmt.Printf("hedging fetch of %s\n", path)
+				start()
+				pending++
+			}
+			continue
+		case result = <-results:
+			pending--
+		}
+		// A failure is only final if no other request is
+		// running.
+		if result.err == nil || pending == 0 {
+			break
+		}
+	}
+
+	if result.err == nil && result.index > 0 {
+		atomic.AddInt64(&k.hedgeWins, 1)
+	}
+	for i, cancel := range cancels {
+		if i != result.index {
+			cancel()
+		}
+	}
+	if pending > 0 {
+		// The loser might still have gotten a response.
+		go func() {
+			for ; pending > 0; pending-- {
+				attempt := <-results
+				if attempt.err == nil {
+					attempt.body.Close()
+				}
+			}
+		}()
+	}
+	return result.body, result.err
+}
@@ -0,0 +1,70 @@
+package keep
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hedgeCache is a testCache whose first fetch of each slow path only
+// ends when it's cancelled.
+type hedgeCache struct {
+	*testCache
+	mu        sync.Mutex
+	slow      map[string]bool
+	cancelled chan string
+}
+
+func newHedgeCache(slow ...string) *hedgeCache {
+	c := &hedgeCache{testCache: newTestCache(), slow: make(map[string]bool), cancelled: make(chan string, 10)}
+	for _, path := range slow {
+		c.slow[path] = true
+	}
+	return c
+}
+
+func (c *hedgeCache) FetchContext(ctx context.Context, path string) (io.ReadCloser, error) {
+	c.mu.Lock()
+	slow := c.slow[path]
+	delete(c.slow, path)
+	c.mu.Unlock()
+	if !slow {
+		return c.Fetch(path)
+	}
+	<-ctx.Done()
+	c.cancelled <- path
+	return nil, ctx.Err()
+}
+
+func TestHedgeWins(t *testing.T) {
+	c := newHedgeCache("/slow")
+	k := newTestKeep(c, func(k *Keep) { k.SetHedging(20*time.Millisecond, 1) })
+
+	if result := request(k, "/slow"); result.err != nil || result.data != "data /slow" {
+		t.Fatalf("got %q, %v", result.data, result.err)
+	}
+	select {
+	case path := <-c.cancelled:
+		if path != "/slow" {
+			t.Errorf("cancelled %s", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the slow request wasn't cancelled")
+	}
+	if stats := k.Stats(); stats.Hedges != 1 || stats.HedgeWins != 1 {
+		t.Errorf("%d hedges, %d wins, want 1 each", stats.Hedges, stats.HedgeWins)
+	}
+
+	// A fetch that's faster than the delay isn't hedged.
+	if result := request(k, "/fast"); result.err != nil {
+		t.Fatal(result.err)
+	}
+	if n := c.fetchCount("/fast"); n != 1 {
+		t.Errorf("%d fetches of /fast", n)
+	}
+	if stats := k.Stats(); stats.Hedges != 1 {
+		t.Errorf("%d hedges after a fast fetch", stats.Hedges)
+	}
+}
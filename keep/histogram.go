@@ -0,0 +1,34 @@
+package keep
+
+// Histogram is a distribution of values, with cumulative buckets like
+// Prometheus histograms.
+type Histogram struct {
+	// Bounds are the upper bounds of the buckets, in increasing
+	// order.
+	Bounds []float64
+	// Counts are the number of values less than or equal to the
+	// bound of the same index.
+	Counts []int
+	// Count is the number of all values, and Sum their sum.
+	Count int
+	Sum   float64
+}
+
+func newHistogram(bounds []float64) Histogram {
+	return Histogram{Bounds: bounds, Counts: make([]int, len(bounds))}
+}
+
+func (h Histogram) copy() Histogram {
+	h.Counts = append([]int(nil), h.Counts...)
+	return h
+}
+
+func (h *Histogram) observe(value float64) {
+	for i, bound := range h.Bounds {
+		if value <= bound {
+			h.Counts[i]++
+		}
+	}
+	h.Count++
+	h.Sum += value
+}
@@ -0,0 +1,32 @@
+package keep
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBytesSaved(t *testing.T) {
+	c := newTestCache()
+	c.setBody("/b", strings.Repeat("x", 20))
+	k := newTestKeep(c, nil)
+	for _, path := range []string{"/a", "/b"} {
+		if err := k.Prime(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		k.Hit("/a")
+	}
+	k.Hit("/b")
+	// Paths that aren't kept don't count.
+	k.Hit("/unknown")
+
+	stats := k.Stats()
+	if stats.Hits != 4 || stats.BytesSaved != 3*int64(len("data /a"))+20 {
+		t.Errorf("got %d hits saving %d bytes", stats.Hits, stats.BytesSaved)
+	}
+	if ei, _ := entryInfo(k, "/a"); ei.Hits != 3 {
+		t.Errorf("entry has %d hits", ei.Hits)
+	}
+}
@@ -0,0 +1,74 @@
+package keep
+
+import (
+	"errors"
+	"path"
+	"sync/atomic"
+)
+
+// ImmutableCacheControl is the Cache-Control header that Header returns
+// for immutable entries.
+const ImmutableCacheControl = "public, max-age=31536000, immutable"
+
+type immutableKeepMessage struct {
+	path      string
+	immutable bool
+}
+
+func (k *Keep) sendImmutableKeepMessage(path string, immutable bool) {
+	msg := immutableKeepMessage{path: path, immutable: immutable}
+	k.messageChannel <- &msg
+}
+
+func (msg *immutableKeepMessage) process(k *Keep) {
+	e, ok := k.entries[msg.path]
+	if !ok {
+		return
+	}
+	if msg.immutable {
+		atomic.StoreInt32(&k.hasImmutables, 1)
+	}
+	e.info.Immutable = msg.immutable
+	k.reschedule(e)
+}
+
+// SetImmutablePatterns makes the entries for paths matching any of
+// patterns, as in path.Match, immutable when they're added.  It must be
+// called before Run.
+func (k *Keep) SetImmutablePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return errors.New("Invalid immutable pattern " + pattern)
+		}
+	}
+	k.immutablePatterns = patterns
+	if len(patterns) > 0 {
+		k.hasImmutables = 1
+	}
+	return nil
+}
+
+// SetImmutable sets whether the entry for path is immutable.  Immutable
+// entries are fetched once and then never refreshed, expired or
+// decayed, and Header has them served with ImmutableCacheControl.  It
+// does nothing if the path is not in the keep.
+func (k *Keep) SetImmutable(path string, immutable bool) {
+	k.sendImmutableKeepMessage(path, immutable)
+}
+
+func (k *Keep) matchesImmutable(p string) bool {
+	for _, pattern := range k.immutablePatterns {
+		matched, _ := path.Match(pattern, p)
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// settled returns whether e is immutable and has been fetched, so it
+// won't ever be fetched again.
+func (e *entry) settled() bool {
+	return e.info.Immutable && e.etag != ""
+}
@@ -1,32 +1,147 @@
 package keep
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
 	"time"
 )
 
 type EntryInfo struct {
-	Path                     string
-	Count                    int
-	LastFetched              time.Time
-	LastDuration			 time.Duration
-	LastErr					 error
-	Fetching                 bool
+	Path         string
+	Count        int
+	LastFetched  time.Time
+	LastDuration time.Duration
+	// LastErr is the error of the last fetch, and LastErrTime when
+	// it failed.  Both are cleared by a successful fetch.
+	LastErr     error
+	LastErrTime time.Time
+	Fetching    bool
+	// Pinned entries don't decay.
+	Pinned bool
+	// Labels must not be modified.
+	Labels map[string]string
+	// Size is the number of bytes of the cached data.
+	Size          int
+	LastRequested time.Time
+	// Requests is the number of requests for the path, and Weight
+	// their total weight, which is what Count grows by.
+	Requests int
+	Weight   int
+	// Hits is the number of requests served from the cache.
+	Hits int
+	// Cold entries were requested only once, and are not refreshed
+	// until they're requested again within the promotion window.
+	Cold bool
+	// Immutable entries are never refreshed once fetched.
+	Immutable bool
+	// Slow is whether the last successful fetch took longer than
+	// the slow threshold.
+	Slow bool
+	// MaxServedAge is the age beyond which the data must not be
+	// served.  Zero means there is no maximum.
+	MaxServedAge time.Duration
+	// Variants is the number of encoded variants stored.
+	Variants int
+	// SoftTTL is the age after which the data is refetched, instead
+	// of the refresh interval.  Zero means there is none.
+	SoftTTL time.Duration
+	// NextRefresh is when the entry is refreshed next, as with
+	// Keep.NextRefresh.  It's only set by Dump.
+	NextRefresh time.Time
 }
 
 type fetchResult struct {
-	Data []byte
-	Err  error
-	duration time.Duration
+	Data      []byte
+	Err       error
+	duration  time.Duration
+	validator string
+	header    http.Header
+	upstream  string
+	// etag is the ETag of the data.  If streamed, the data was
+	// streamed to the cache instead of being returned, and
+	// streamedSize is its size.
+	etag         string
+	streamed     bool
+	streamedSize int
+	// softTTL and hardTTL are taken from the response headers.
+	softTTL time.Duration
+	hardTTL time.Duration
+	// uncached is whether the data wasn't written to the cache for
+	// the path, because the fetch was abandoned or pre-empted by a
+	// push.
+	uncached bool
+}
+
+// FetchInfo describes a finished fetch.
+type FetchInfo struct {
+	Path string
+	// Data is the body as served, after transforms.  It's nil if
+	// the body was streamed to the cache.
+	Data        []byte
+	ContentType string
+	Status      int
+	// FromCache is whether the data was taken from the cache
+	// because the upstream reported it unchanged.
+	FromCache bool
+	Duration  time.Duration
+	Err       error
+	// Upstream is the upstream that served the data, if the cache
+	// reports it.
+	Upstream string
+	// Cached is whether the data is written to the cache.
+	Cached bool
 }
 
 type entry struct {
-	info EntryInfo
-	// Each waiter is a channel waiting for a byte slice.
-	// If the fetch fails we close the channel.
+	info      EntryInfo
+	validator string
+	etag      string
+	header    http.Header
+	// cancel cancels the context of the entry's background
+	// refresh, and cancelled is whether it was.
+	cancel    context.CancelFunc
+	cancelled bool
+	// variants are the encodings of the variants stored, with
+	// when they were last requested.
+	variants map[string]time.Time
+	// fetches is the number of successful fetches, which tokens
+	// count, and tokenWaiters are waiting for later ones, or for
+	// writes, the number of writes of fetched data to the cache
+	// still running.  refreshPending is whether Refresh was called
+	// while fetching.
+	fetches        uint64
+	tokenWaiters   []tokenWaiter
+	writes         int
+	refreshPending bool
+	// pushes is the number of times data was pushed, and
+	// fetchPushes what it was when the running fetch started, whose
+	// result is dropped if it changed since.  pushWaiters are pushes
+	// waiting for writes to finish.
+	pushes      uint64
+	fetchPushes uint64
+	pushWaiters []chan<- bool
+	// revalidating is whether the entry's background refresh
+	// checks its validator first.
+	revalidating bool
+	// due is when the entry's item in the schedule is due, or zero
+	// if it's not scheduled.  timer is set for it with per-entry
+	// timers.
+	due   time.Time
+	timer *time.Timer
+	// Each waiter is a channel waiting for the fetch result, with
+	// room for it, so sending never blocks the loop.  Then we close
+	// the channel.
 	waiters []chan<- fetchResult
 }
 
@@ -35,7 +150,8 @@ type keepMessage interface {
 }
 
 type requestKeepMessage struct {
-	path string
+	path   string
+	weight int
 }
 
 type fetchingKeepMessage struct {
@@ -54,26 +170,192 @@ type dumpKeepMessage struct {
 
 type dontReloadKeepMessage struct {
 	path string
+	// drop is whether to drop the cached data, too.
+	drop bool
+}
+
+type touchKeepMessage struct {
+	path string
+}
+
+type hitKeepMessage struct {
+	path string
+}
+
+type containsKeepMessage struct {
+	path  string
+	reply chan<- bool
+}
+
+// EmptyBodyPolicy determines how empty upstream bodies are handled.
+type EmptyBodyPolicy int
+
+const (
+	// EmptyBodyServe caches and serves empty bodies like any other.
+	EmptyBodyServe EmptyBodyPolicy = iota
+	// EmptyBodyNoContent caches empty bodies, which are to be
+	// served as No Content.
+	EmptyBodyNoContent
+	// EmptyBodyReject fails fetches that return an empty body.
+	EmptyBodyReject
+)
+
+// WaiterStrategy determines how requests waiting for a fetch are
+// handled.
+type WaiterStrategy int
+
+const (
+	// WaitersInLoop hands the result to all waiters from the run
+	// loop, which is blocked until they've all received it.
+	WaitersInLoop WaiterStrategy = iota
+	// WaitersAsync hands the result to waiters from a separate
+	// goroutine.
+	WaitersAsync
+	// WaitersShed fails requests right away with
+	// ErrTooManyWaiters if too many are already waiting.
+	WaitersShed
+)
+
+// ErrTooManyWaiters is returned to requests shed under WaitersShed.
+var ErrTooManyWaiters = errors.New("Too many requests waiting for fetch")
+
+// ErrReadOnly is returned for data that would have to be fetched by a
+// read-only keep.
+var ErrReadOnly = errors.New("Keep is read-only")
+
+// ErrEmptyBody is returned for empty bodies under EmptyBodyReject.
+var ErrEmptyBody = errors.New("Endpoint returned an empty body")
+
+// ErrNotCached is returned by Prime for data that was fetched, but not
+// cached.
+var ErrNotCached = errors.New("Data was not cached")
+
+// ErrTruncated is returned for bodies shorter or longer than their
+// Content-Length if lengths are checked.
+var ErrTruncated = errors.New("Body length does not match Content-Length")
+
+// UpstreamError is a fetch that failed because of the upstream.  Caches
+// can return it from Fetch to say why, and it's passed on to waiters.
+type UpstreamError struct {
+	// Timeout is whether the upstream didn't respond in time.
+	Timeout bool
+	// Status is the error status the upstream responded with, or
+	// zero if there was no response.
+	Status int
+	Err    error
+}
+
+func (e *UpstreamError) Error() string {
+	return e.Err.Error()
 }
 
 type Cache interface {
 	Fetch(path string) (io.ReadCloser, error)
+	Get(path string) ([]byte, error)
 	Set(path string, data []byte) error
 	Delete(path string) error
 }
 
+// UpstreamBody is implemented by bodies returned by Fetch that know
+// which of several upstreams they're from.
+type UpstreamBody interface {
+	Upstream() string
+}
+
 type Keep struct {
-	entries           map[string]*entry
-	timer             *time.Timer
-	messageChannel    chan keepMessage
-	cache             Cache
-	expireDuration    time.Duration
-	numExpiresToDecay int
-	durationThreshold time.Duration
+	entries            map[string]*entry
+	timer              *time.Timer
+	timerDue           time.Time
+	schedule           schedule
+	perEntryTimers     bool
+	due                []scheduleItem
+	messageChannel     chan keepMessage
+	cache              Cache
+	expireDuration     time.Duration
+	numExpiresToDecay  int
+	durationThreshold  time.Duration
+	transforms         []Transform
+	emptyBodyPolicy    EmptyBodyPolicy
+	maxFetches         int
+	encodings          []string
+	snapshotFormat     SnapshotFormat
+	spawner            spawner
+	validateRefreshes  bool
+	maxStartDelay      time.Duration
+	refreshStart       time.Time
+	verifyRate         float64
+	upstreamMapper     func(path string) string
+	waiterStrategy     WaiterStrategy
+	maxWaiters         int
+	readOnly           bool
+	replayHeaders      map[string]bool
+	strippedHeaders    map[string]bool
+	maxBytes           int64
+	totalBytes         int64
+	evictionPolicy     EvictionPolicy
+	onFetch            func(info FetchInfo)
+	onWaiter           func(path string, waiters int)
+	cacheableHeader    string
+	streamThreshold    int64
+	presenceInterval   time.Duration
+	checkLengths       bool
+	paused             int32
+	pauseBlocksFetches bool
+	writeTimeout       time.Duration
+	refreshProbability float64
+	writeTimeouts      int64
+	hedgeDelay         time.Duration
+	maxHedges          int32
+	hedging            int32
+	hedges             int64
+	hedgeWins          int64
+	newETagHash        func() hash.Hash
+	skipUnchanged      bool
+	honorCacheControl  bool
+	maxVariants        int
+	closed             context.Context
+	closeWrites        context.CancelFunc
+	statsLabelKeys     []string
+	maxLabelValues     int
+	labelValues        map[string]map[string]bool
+	labelStats         map[string]*LabelStats
+	promotionWindow    time.Duration
+	presenceSamples    int
+	immutablePatterns  []string
+	hasImmutables      int32
+	slowThreshold      time.Duration
+	slowFactor         int
+	onSlow             func(path string, slow bool)
+	numFetching        int
+	stats              Stats
+	logger             Logger
+	debug              bool
+
+	// Data of finished fetches that the run loop hasn't processed
+	// yet, by path, so that requests don't have to wait for it.
+	// noStash turns it off, for benchmarks to compare.
+	stash   sync.Map
+	noStash bool
+	// Upstream paths registered for paths, which override the
+	// mapper.
+	upstreams sync.Map
+
+	breakerThreshold float64
+	breakerCooldown  time.Duration
+	breakerState     breakerState
+	breakerOpenUntil time.Time
+	onBreaker        func(open bool)
+
+	refreshInterval    time.Duration
+	maxRefreshInterval time.Duration
+	latencyTarget      time.Duration
+	maxErrorRate       float64
+	averageLatency     time.Duration
+	errorRate          float64
 }
 
-func (k *Keep) sendRequestMessage(path string) {
-	msg := requestKeepMessage{path: path}
+func (k *Keep) sendRequestMessage(path string, weight int) {
+	msg := requestKeepMessage{path: path, weight: weight}
 	k.messageChannel <- &msg
 }
 
@@ -92,17 +374,44 @@ func (k *Keep) sendDumpKeepMessage(channel chan<- EntryInfo) {
 	k.messageChannel <- &msg
 }
 
-func (k *Keep) sendDontReloadKeepMessage(path string) {
-	msg := dontReloadKeepMessage{path: path}
+func (k *Keep) sendDontReloadKeepMessage(path string, drop bool) {
+	msg := dontReloadKeepMessage{path: path, drop: drop}
+	k.messageChannel <- &msg
+}
+
+func (k *Keep) sendTouchKeepMessage(path string) {
+	msg := touchKeepMessage{path: path}
+	k.messageChannel <- &msg
+}
+
+func (k *Keep) sendHitKeepMessage(path string) {
+	msg := hitKeepMessage{path: path}
+	k.messageChannel <- &msg
+}
+
+func (k *Keep) sendContainsKeepMessage(path string, reply chan<- bool) {
+	msg := containsKeepMessage{path: path, reply: reply}
 	k.messageChannel <- &msg
 }
 
 func (k *Keep) PathRequested(path string) {
-	k.sendRequestMessage(path)
+	k.sendRequestMessage(path, 1)
+}
+
+// PathRequestedWithWeight is like PathRequested, but counts the request
+// weight times, so that the path stays in the keep longer.  Weights
+// less than one count as one.
+func (k *Keep) PathRequestedWithWeight(path string, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	k.sendRequestMessage(path, weight)
 }
 
 func (k *Keep) tryLookup(path string) (fetchResult, bool) {
-	waiter := make(chan fetchResult)
+	// The channel is buffered so that the loop never blocks handing
+	// us the result, even if we're gone by then.
+	waiter := make(chan fetchResult, 1)
 	k.sendFetchingMessage(path, waiter)
 
 	result, ok := <-waiter
@@ -112,132 +421,402 @@ func (k *Keep) tryLookup(path string) (fetchResult, bool) {
 type WriterMaker func(w io.Writer) io.Writer
 
 func (k *Keep) WaitOrFetch(path string, writerMaker WriterMaker) ([]byte, error) {
+	data, _, err := k.waitOrFetch(path, writerMaker)
+	return data, err
+}
+
+// waitOrFetch is WaitOrFetch, also returning whether the data is
+// cached.
+func (k *Keep) waitOrFetch(path string, writerMaker WriterMaker) ([]byte, bool, error) {
+	if k.readOnly {
+		return nil, false, ErrReadOnly
+	}
+	if k.pauseBlocksFetches && k.Paused() {
+		return nil, false, ErrPaused
+	}
+
+	if data, ok := k.stash.Load(path); ok {
+		fmt.Printf("got result from finished fetch\n")
+		return data.([]byte), true, nil
+	}
+
 	result, ok := k.tryLookup(path)
 	if ok {
 		fmt.Printf("got result from parallel fetch\n")
 		if result.Err != nil {
-			return nil, result.Err
+			return nil, false, result.Err
 		}
-		return result.Data, nil
+		if result.streamed {
+			data, err := k.cache.Get(path)
+			return data, err == nil, err
+		}
+		// Data that's not cached isn't handed to the waiters, or
+		// they're told it's not cached.
+		return result.Data, result.Data != nil && !result.uncached, nil
+	}
+
+	info, err := k.fetch(context.Background(), path, writerMaker)
+	return nil, info.Cached, err
+}
+
+// Prime fetches path into the cache without serving it, and adds it to
+// the keep.  If the data was fetched, but not cached, because the fetch
+// was faster than the duration threshold or the response said it's not
+// cacheable, it returns ErrNotCached.
+func (k *Keep) Prime(path string) error {
+	k.PathRequested(path)
+	_, cached, err := k.waitOrFetch(path, func(w io.Writer) io.Writer { return w })
+	if err == nil && !cached {
+		return ErrNotCached
 	}
+	return err
+}
 
-	return nil, k.fetch(path, writerMaker)
+func (k *Keep) fetch(ctx context.Context, path string, writerMaker WriterMaker) (FetchInfo, error) {
+	return k.fetchAliases(ctx, []string{path}, "", writerMaker)
 }
 
-func (k *Keep) fetch(path string, writerMaker WriterMaker) error {
+// fetchAliases fetches the first of paths, which must all have the
+// same upstream path, and stores the result for all of them.  previous
+// is the ETag of the data already in the cache, if it's known.
+func (k *Keep) fetchAliases(ctx context.Context, paths []string, previous string, writerMaker WriterMaker) (FetchInfo, error) {
 	var data []byte
 	var err error
 	var duration time.Duration
+	var validator string
+	var header http.Header
+	var upstream string
+	var etag string
+	streamed := false
+	var softTTL, hardTTL time.Duration
+	var contentLength int64 = -1
+	cacheable := true
+	path := paths[0]
+	info := FetchInfo{Path: path}
+	// written has the paths whose data is in the cache, or being
+	// written to it, which are the only ones whose data is stashed.
+	written := make(map[string]bool)
 
 	// If we don't do this, a request error will lead to
 	// the entry always being in fetching state, but it won't
 	// ever actually be fetched again.
-	defer func() { k.sendFetchedMessage(path, fetchResult{Data: data, Err: err, duration: duration}) }()
+	defer func() {
+		for _, p := range paths {
+			uncached := data != nil && !written[p]
+			if err == nil && data != nil && !uncached && !k.noStash {
+				k.stash.Store(p, data)
+			}
+			k.sendFetchedMessage(p, fetchResult{Data: data, Err: err, duration: duration, validator: validator, header: header, upstream: upstream,
+				etag: etag, streamed: streamed, streamedSize: int(contentLength), softTTL: softTTL, hardTTL: hardTTL, uncached: uncached})
+		}
+		info.Duration = duration
+		info.Err = err
+		k.fetched(info)
+	}()
 
 	startTime := time.Now()
-	resp, err := k.cache.Fetch(path)
+	resp, err := k.fetchUpstream(ctx, k.upstreamPath(path))
 	endTime := time.Now()
 	duration = endTime.Sub(startTime)
 	if err != nil {
-		return err
+		return info, err
 	}
 	defer resp.Close()
+	if vb, ok := resp.(ValidatedBody); ok {
+		validator = vb.Validator()
+	}
+	if ub, ok := resp.(UpstreamBody); ok {
+		upstream = ub.Upstream()
+		info.Upstream = upstream
+	}
+	if rb, ok := resp.(ResponseBody); ok {
+		info.Status = rb.StatusCode()
+		info.ContentType = rb.Header().Get("Content-Type")
+		if len(k.replayHeaders) > 0 {
+			header = k.replayedHeader(rb.Header())
+		}
+		if k.cacheableHeader != "" {
+			cacheable = isCacheable(rb.Header().Get(k.cacheableHeader))
+		}
+		if k.honorCacheControl {
+			softTTL, hardTTL = parseTTLs(rb.Header())
+		}
+		length, lengthErr := strconv.ParseInt(rb.Header().Get("Content-Length"), 10, 64)
+		if lengthErr == nil {
+			contentLength = length
+		}
+	}
+
+	empty := false
+	var reader io.Reader = resp
+	if k.emptyBodyPolicy != EmptyBodyServe {
+		bufferedReader := bufio.NewReader(resp)
+		_, peekErr := bufferedReader.Peek(1)
+		empty = peekErr == io.EOF
+		reader = bufferedReader
+	}
+	if empty && k.emptyBodyPolicy == EmptyBodyReject {
+		err = ErrEmptyBody
+		return info, err
+	}
 
 	buffer := new(bytes.Buffer)
-	writer := writerMaker(buffer)
+	var body []byte
+	if empty {
+		// We don't make a writer, so that the caller can
+		// serve No Content instead.
+		body = []byte{}
+	} else if sc, ok := k.shouldStream(paths, contentLength); ok && cacheable && duration >= k.durationThreshold {
+		// The data is neither buffered nor stashed, so waiters
+		// have to get it from the cache.
+		var setErr error
+		streamed = true
+		etag, setErr, err = k.streamToCache(sc, path, reader, contentLength, writerMaker)
+		if err != nil {
+			fmt.Printf("copy error\n")
+			return info, err
+		}
+		if setErr != nil {
+			fmt.Printf("cache set error\n")
+			k.sendDontReloadKeepMessage(path, false)
+			return info, nil
+		}
+		info.Cached = true
+		if len(k.encodings) > 0 {
+			k.spawner.spawn(func() { k.fetchVariants(path) })
+		}
+		return info, nil
+	} else if len(k.transforms) == 0 {
+		writer := writerMaker(buffer)
 
-	_, err = io.Copy(writer, resp)
-	if err != nil {
-		fmt.Printf("copy error\n")
-		return err
+		var n int64
+		n, err = io.Copy(writer, reader)
+		if err == nil {
+			err = k.checkLength(n, contentLength)
+		}
+		if err != nil {
+			fmt.Printf("copy error\n")
+			return info, err
+		}
+		body = buffer.Bytes()
+	} else {
+		// The transformed body is what we serve, so we can't
+		// stream the response to the client while copying.
+		var n int64
+		n, err = io.Copy(buffer, reader)
+		if err == nil {
+			err = k.checkLength(n, contentLength)
+		}
+		if err != nil {
+			fmt.Printf("copy error\n")
+			return info, err
+		}
+		body, err = k.applyTransforms(path, buffer.Bytes())
+		if err != nil {
+			fmt.Printf("transform error\n")
+			return info, err
+		}
+		_, err = writerMaker(ioutil.Discard).Write(body)
+		if err != nil {
+			return info, err
+		}
 	}
-	
-	if duration < k.durationThreshold {
-		k.sendDontReloadKeepMessage(path)
-		return nil
+
+	info.Data = body
+
+	if duration < k.durationThreshold || !cacheable {
+		if !cacheable {
+			fmt.Printf("not caching %s\n", path)
+		}
+		for _, p := range paths {
+			// What we cached before must not be served
+			// anymore.
+			k.sendDontReloadKeepMessage(p, !cacheable)
+		}
+		return info, nil
 	}
 
-	data = buffer.Bytes()
+	data = body
+	etag = k.computeETag(data)
 
-	go func() {
-		err := k.cache.Set(path, data)
-		if err != nil {
-			fmt.Printf("cache set error\n")
-			k.sendDontReloadKeepMessage(path)
+	if k.skipUnchanged && etag == previous {
+		fmt.Printf("unchanged %s\n", path)
+		info.Cached = true
+		for _, p := range paths {
+			written[p] = true
 		}
-	}()
+		return info, nil
+	}
 
-	return nil
+	if ctx.Err() != nil {
+		// The fetch was abandoned, so nobody wants the data
+		// cached anymore.
+		fmt.Printf("not caching abandoned %s\n", path)
+		return info, nil
+	}
+
+	for _, p := range paths {
+		p := p
+		if !k.startWrite(p) {
+			fmt.Printf("not caching %s, which was pushed\n", p)
+			continue
+		}
+		info.Cached = true
+		written[p] = true
+		k.spawner.spawn(func() {
+			defer k.finishWrite(p)
+			err := k.setData(p, data)
+			if err != nil {
+				fmt.Printf("cache set error\n")
+				k.sendDontReloadKeepMessage(p, false)
+				return
+			}
+			if len(k.encodings) > 0 {
+				k.fetchVariants(p)
+			}
+		})
+	}
+
+	return info, nil
 }
 
 func (k *Keep) expireTime(ei EntryInfo) time.Time {
-	duration := time.Duration(math.Max(float64(k.expireDuration), float64(ei.LastDuration*5)))
+	interval := k.refreshInterval
+	if ei.SoftTTL > 0 {
+		interval = ei.SoftTTL
+	}
+	duration := time.Duration(math.Max(float64(interval), float64(ei.LastDuration*5)))
+	if ei.Slow && k.slowFactor > 1 {
+		duration *= time.Duration(k.slowFactor)
+	}
 	return ei.LastFetched.Add(duration)
 }
 
-func (k *Keep) fetchExpired() {
+// fetchExpired starts fetches for all expired entries, taking them
+// from the top of the schedule.  It returns whether it had to leave
+// some of them for later because too many fetches are already running.
+// Those that expired first are fetched first, and a fetched entry is
+// only due again after a full interval, so no entry is starved of
+// refreshes while throttled.
+func (k *Keep) fetchExpired() (throttled bool) {
 	fmt.Printf("fetching expired\n")
 	now := time.Now()
-	for _, e := range k.entries {
-		if e.info.Fetching || e.info.Count <= 0 {
-			continue
+	if k.breakerState == breakerOpen && now.After(k.breakerOpenUntil) {
+		fmt.Printf("probing upstream\n")
+		k.breakerState = breakerProbing
+	}
+	probe := k.breakerState == breakerProbing
+	aliases := make(map[string][]*entry)
+	for {
+		e, ok := k.nextDue()
+		if !ok || !k.expireTime(e.info).Before(now) {
+			break
+		}
+		if k.maxFetches > 0 && k.numFetching >= k.maxFetches || probe && k.numFetching > 0 {
+			if k.debug {
+				k.debugf("REFRESH %s deferred, %d fetches running", e.info.Path, k.numFetching)
+			}
+			throttled = true
+			break
 		}
-		expireTime := k.expireTime(e.info)
-		expired := expireTime.Before(now)
-		if expired {
+		k.popDue(e)
+		if !e.info.Pinned {
 			e.info.Count--
 		}
 		if e.info.Count <= 0 {
 			fmt.Printf("deleting %s\n", e.info.Path)
-			k.cache.Delete(e.info.Path)
+			if k.debug {
+				k.debugf("DECAY %s", e.info.Path)
+			}
+			k.dropData(e)
 			// FIXME: delete entry, too
 			continue
 		}
-		if !expired {
+		if k.refreshProbability > 0 && rand.Float64() >= k.refreshProbability {
+			// Another instance sharing the cache is likely
+			// to refresh it.
+			e.info.LastFetched = now
+			k.stats.SkippedRefreshes++
+			k.reschedule(e)
 			continue
 		}
 
 		fmt.Printf("fetching %s\n", e.info.Path)
 		e.info.Fetching = true
-		go k.fetch(e.info.Path, func(w io.Writer) io.Writer { return w })
+		e.fetchPushes = e.pushes
+		k.numFetching++
+		upstream := k.upstreamPath(e.info.Path)
+		aliases[upstream] = append(aliases[upstream], e)
 	}
-}
 
-func (k *Keep) shortestTimeout() (duration time.Duration, expiring bool) {
-	now := time.Now()
-	earliest := now.Add(time.Hour * 24 * 365)
-	expiring = false
-	for _, e := range k.entries {
-		if e.info.Fetching || e.info.Count <= 0 {
+	// Paths with the same upstream path are only fetched once.
+	for _, es := range aliases {
+		if len(es) == 1 {
+			path := es[0].info.Path
+			validator := ""
+			if k.validateRefreshes {
+				validator = es[0].validator
+			}
+			// Only a fetch for a single entry can be
+			// abandoned.
+			ctx, cancel := context.WithCancel(context.Background())
+			es[0].cancel = cancel
+			etag := es[0].etag
+			es[0].revalidating = validator != ""
+			k.spawner.spawn(func() { k.refresh(ctx, path, validator, etag) })
 			continue
 		}
-		expireTime := k.expireTime(e.info)
-		if expireTime.Before(earliest) {
-			earliest = expireTime
-			expiring = true
+
+		var paths []string
+		for _, e := range es {
+			paths = append(paths, e.info.Path)
 		}
+		k.spawner.spawn(func() { k.fetchAliases(context.Background(), paths, "", func(w io.Writer) io.Writer { return w }) })
 	}
-	if earliest.Before(now) {
-		return 0, expiring
-	}
-	return earliest.Sub(now), expiring
+	return throttled
+}
+
+func (k *Keep) setTimer(due time.Time) {
+	k.timer = time.NewTimer(due.Sub(time.Now()))
+	k.timerDue = due
 }
 
+// updateServiceTimer refetches what's due and sets the timer for when
+// the next entry is due.  Only the entries at the top of the schedule
+// are looked at, so a wakeup doesn't scan the whole keep.
 func (k *Keep) updateServiceTimer() {
 	if k.timer != nil {
 		return
 	}
 
+	if k.readOnly || k.Paused() {
+		return
+	}
+
+	if time.Now().Before(k.refreshStart) {
+		k.setTimer(k.refreshStart)
+		return
+	}
+
+	if k.breakerState == breakerOpen && time.Now().Before(k.breakerOpenUntil) {
+		k.setTimer(k.breakerOpenUntil)
+		return
+	}
+
 	for {
-		k.fetchExpired()
+		if k.fetchExpired() {
+			// We'll get here again once a fetch has finished.
+			return
+		}
 
-		duration, expiring := k.shortestTimeout()
-		if !expiring {
+		e, ok := k.nextDue()
+		if !ok {
 			return
 		}
 
-		if duration > 0 {
-			k.timer = time.NewTimer(duration)
+		due := k.expireTime(e.info)
+		if due.After(time.Now()) {
+			k.setTimer(due)
 			return
 		}
 	}
@@ -248,12 +827,29 @@ func (rkm *requestKeepMessage) process(k *Keep) {
 
 	e, ok := k.entries[path]
 	if !ok {
-		e = &entry{info: EntryInfo{Path: path, Count: k.numExpiresToDecay, LastFetched: time.Now()}}
+		now := time.Now()
+		e = &entry{info: EntryInfo{Path: path,
+			Count:         k.numExpiresToDecay * rkm.weight,
+			LastFetched:   now,
+			LastRequested: now,
+			Requests:      1,
+			Weight:        rkm.weight,
+			Cold:          k.promotionWindow > 0,
+			Immutable:     k.matchesImmutable(path)}}
 		k.entries[path] = e
+		k.reschedule(e)
 		return
 	}
 
-	e.info.Count += k.numExpiresToDecay
+	now := time.Now()
+	if e.info.Cold && now.Sub(e.info.LastRequested) <= k.promotionWindow {
+		e.info.Cold = false
+	}
+	e.info.Count += k.numExpiresToDecay * rkm.weight
+	e.info.LastRequested = now
+	e.info.Requests++
+	e.info.Weight += rkm.weight
+	k.reschedule(e)
 }
 
 func (msg *fetchingKeepMessage) process(k *Keep) {
@@ -265,11 +861,21 @@ func (msg *fetchingKeepMessage) process(k *Keep) {
 	}
 
 	if e.info.Fetching {
+		if k.waiterStrategy == WaitersShed && len(e.waiters) >= k.maxWaiters {
+			msg.waiter <- fetchResult{Err: ErrTooManyWaiters}
+			close(msg.waiter)
+			return
+		}
 		fmt.Printf("adding waiter\n")
 		e.waiters = append(e.waiters, msg.waiter)
+		if k.onWaiter != nil {
+			k.onWaiter(path, len(e.waiters))
+		}
 	} else {
 		close(msg.waiter)
 		e.info.Fetching = true
+		e.fetchPushes = e.pushes
+		k.numFetching++
 	}
 }
 
@@ -285,21 +891,111 @@ func (msg *fetchedKeepMessage) process(k *Keep) {
 		panic("We got a fetched, but we're not fetching")
 	}
 
-	e.info.LastFetched = time.Now()
 	e.info.Fetching = false
+	k.numFetching--
+	e.revalidating = false
+	// The result of a fetch that was abandoned is discarded even if
+	// it succeeded, because the entry's data was dropped since, and
+	// so is that of a fetch that started before data was pushed.
+	cancelled := e.cancelled || e.pushes != e.fetchPushes
+	if e.cancel != nil {
+		e.cancel()
+		e.cancel = nil
+		e.cancelled = false
+	}
+	if cancelled {
+		// The fetch didn't tell us anything about the entry or
+		// the upstream that's still true.
+		k.stash.Delete(path)
+		k.notifyWaiters(e, msg.result)
+		k.reschedule(e)
+		return
+	}
+	now := time.Now()
+	e.info.LastFetched = now
+	if e.refreshPending {
+		e.refreshPending = false
+		e.info.LastFetched = time.Time{}
+	}
 	e.info.LastDuration = msg.result.duration
 	e.info.LastErr = msg.result.Err
+	e.info.LastErrTime = time.Time{}
+	if msg.result.Err != nil {
+		e.info.LastErrTime = now
+	}
+	if msg.result.Err == nil {
+		e.validator = msg.result.validator
+		if msg.result.Data != nil {
+			e.etag = msg.result.etag
+			k.setSize(e, len(msg.result.Data))
+			k.stats.ResponseSizes.observe(float64(len(msg.result.Data)))
+		} else if msg.result.streamed {
+			e.etag = msg.result.etag
+			k.setSize(e, msg.result.streamedSize)
+			k.stats.ResponseSizes.observe(float64(msg.result.streamedSize))
+		}
+		if msg.result.header != nil {
+			e.header = msg.result.header
+		}
+		k.updateTTLs(e, msg.result)
+		e.fetches++
+	}
+
+	k.stats.Fetches++
+	k.stats.FetchDurations.observe(msg.result.duration.Seconds())
+	if msg.result.upstream != "" {
+		if k.stats.Upstreams == nil {
+			k.stats.Upstreams = make(map[string]int)
+		}
+		k.stats.Upstreams[msg.result.upstream]++
+	}
+	if msg.result.Err != nil {
+		k.stats.FetchErrors++
+		if k.debug {
+			k.debugf("REFRESH %s failed after %s: %s", path, msg.result.duration, msg.result.Err)
+		}
+	} else if k.debug {
+		k.debugf("REFRESH %s done in %s, %d bytes", path, msg.result.duration, len(msg.result.Data))
+	}
+	k.countLabelStats(e.info, msg.result)
+	k.observeFetch(msg.result)
+	k.tuneRefreshInterval()
+	k.updateBreaker(msg.result)
+	k.updateSlow(e, msg.result)
+	k.evict(e)
+	k.reschedule(e)
+
+	// The waiters are getting the data, so requests can't get it
+	// from the stash anymore.
+	k.stash.Delete(path)
+
+	k.notifyWaiters(e, msg.result)
+	k.notifyTokenWaiters(e, msg.result)
+}
 
-	for _, waiter := range e.waiters {
-		waiter <- msg.result
+// notifyWaiters hands result to the waiters of e.
+func (k *Keep) notifyWaiters(e *entry, result fetchResult) {
+	if k.waiterStrategy == WaitersAsync {
+		go notify(e.waiters, result)
+		e.waiters = nil
+	} else {
+		notify(e.waiters, result)
+		e.waiters = e.waiters[0:0]
+	}
+}
+
+func notify(waiters []chan<- fetchResult, result fetchResult) {
+	for _, waiter := range waiters {
+		waiter <- result
 		close(waiter)
 	}
-	e.waiters = e.waiters[0:0]
 }
 
 func (msg *dumpKeepMessage) process(k *Keep) {
 	for _, e := range k.entries {
-		msg.channel <- e.info
+		info := e.info
+		info.NextRefresh, _ = k.nextRefresh(e)
+		msg.channel <- info
 	}
 	close(msg.channel)
 }
@@ -313,11 +1009,48 @@ func (msg *dontReloadKeepMessage) process(k *Keep) {
 	}
 
 	e.info.Count = 0
+	if msg.drop {
+		k.dropData(e)
+	}
+}
+
+func (msg *touchKeepMessage) process(k *Keep) {
+	e, ok := k.entries[msg.path]
+	if !ok || e.info.Fetching {
+		return
+	}
+
+	e.info.LastFetched = time.Now()
+	k.reschedule(e)
+}
+
+func (msg *hitKeepMessage) process(k *Keep) {
+	e, ok := k.entries[msg.path]
+	if !ok {
+		return
+	}
+	e.info.Hits++
+	k.stats.Hits++
+	k.stats.BytesSaved += int64(e.info.Size)
+}
+
+func (msg *containsKeepMessage) process(k *Keep) {
+	_, ok := k.entries[msg.path]
+	msg.reply <- ok
 }
 
 // Run runs the keep in an endless loop.  You should probably
 // run this in a goroutine.
 func (k *Keep) Run() {
+	if k.maxStartDelay > 0 {
+		delay := time.Duration(rand.Int63n(int64(k.maxStartDelay)))
+		fmt.Printf("delaying refreshes by %s\n", delay)
+		k.refreshStart = time.Now().Add(delay)
+	}
+	if k.presenceInterval > 0 {
+		go k.checkPresence()
+	}
+
 	k.updateServiceTimer()
 	for {
 		var timerChannel <-chan time.Time
@@ -347,14 +1080,180 @@ func (k *Keep) Dump() []EntryInfo {
 	return infos
 }
 
+// Hit records that a request for path was served from the cache,
+// saving a fetch from the upstream.
+func (k *Keep) Hit(path string) {
+	k.sendHitKeepMessage(path)
+}
+
+// Touch marks the data for path as fresh without fetching it, so its
+// next refetch is a full expire duration away.  It does nothing if the
+// path is not in the keep or is being fetched.
+func (k *Keep) Touch(path string) {
+	k.sendTouchKeepMessage(path)
+}
+
+// Contains returns whether the keep has an entry for path.
+func (k *Keep) Contains(path string) bool {
+	c := make(chan bool, 1)
+	k.sendContainsKeepMessage(path, c)
+	return <-c
+}
+
+// SetMaxFetches limits the number of fetches running at the same time.
+// Expired entries beyond the limit are fetched once other fetches have
+// finished.  Requests for paths not in the cache are never delayed.
+// Zero, the default, means no limit.  It must be called before Run.
+func (k *Keep) SetMaxFetches(n int) {
+	k.maxFetches = n
+}
+
+// SetMaxStartDelay makes Run wait a random duration of up to max
+// before refreshing any entries, so that instances started together
+// don't all refresh in sync.  The default is zero.  It must be called
+// before Run.
+func (k *Keep) SetMaxStartDelay(max time.Duration) {
+	k.maxStartDelay = max
+}
+
+// SetUpstreamMapper makes the keep fetch from the upstream path that
+// mapper returns for a path, instead of the path itself.  Paths mapping
+// to the same upstream path are fetched only once when they're
+// refreshed together.  It must be called before Run.
+func (k *Keep) SetUpstreamMapper(mapper func(path string) string) {
+	k.upstreamMapper = mapper
+}
+
+func (k *Keep) upstreamPath(path string) string {
+	if upstream, ok := k.upstreams.Load(path); ok {
+		return upstream.(string)
+	}
+	if k.upstreamMapper == nil {
+		return path
+	}
+	return k.upstreamMapper(path)
+}
+
+// SetWaiterStrategy sets how requests waiting for a fetch are handled.
+// maxWaiters is the number of waiters per path under WaitersShed.  The
+// default is WaitersInLoop.  It must be called before Run.
+func (k *Keep) SetWaiterStrategy(strategy WaiterStrategy, maxWaiters int) {
+	k.waiterStrategy = strategy
+	k.maxWaiters = maxWaiters
+}
+
+// SetReadOnly makes the keep never contact the upstream.  It only
+// serves what's already in the cache: entries are not refreshed, and
+// WaitOrFetch and Prime return ErrReadOnly.  Unregister and
+// InvalidateByLabel do nothing, so the cache is never written.  It must
+// be called before Run.
+func (k *Keep) SetReadOnly(readOnly bool) {
+	k.readOnly = readOnly
+}
+
+// SetOnFetch makes the keep call onFetch after every fetch from the
+// upstream, in the goroutine that did the fetch.  It must be called
+// before Run.
+func (k *Keep) SetOnFetch(onFetch func(info FetchInfo)) {
+	k.onFetch = onFetch
+}
+
+// SetOnWaiter makes the keep call onWaiter whenever a request starts
+// waiting for a fetch of path that's already running, with the number
+// of requests now waiting.  It's called from the run loop, so it must
+// not block or call the keep.  Together with a Cache whose Fetch blocks
+// until released, it lets tests know when requests have coalesced.  It
+// must be called before Run.
+func (k *Keep) SetOnWaiter(onWaiter func(path string, waiters int)) {
+	k.onWaiter = onWaiter
+}
+
+func (k *Keep) fetched(info FetchInfo) {
+	if k.onFetch != nil {
+		k.onFetch(info)
+	}
+}
+
+// SetCheckLengths makes fetches fail with ErrTruncated if the body is
+// not as long as the upstream's Content-Length says, so that truncated
+// bodies are not cached.  Bodies without a Content-Length are not
+// checked.  It must be called before Run.
+func (k *Keep) SetCheckLengths(check bool) {
+	k.checkLengths = check
+}
+
+func (k *Keep) checkLength(n int64, contentLength int64) error {
+	if k.checkLengths && contentLength >= 0 && n != contentLength {
+		fmt.Printf("read %d bytes instead of %d\n", n, contentLength)
+		return ErrTruncated
+	}
+	return nil
+}
+
+// SetRefreshProbability makes the keep refresh only a fraction p of the
+// entries that are due, chosen at random, and treat the others as
+// refreshed.  It's for instances sharing a cache, each of which can do
+// a share of the refreshes, such as 1/n of them for n instances.  The
+// data of skipped entries is still served from the cache, but their
+// ETags are not updated.  Zero, the default, refreshes all entries.  It
+// must be called before Run.
+func (k *Keep) SetRefreshProbability(p float64) {
+	k.refreshProbability = p
+}
+
+// SetPromotionWindow makes the keep refresh entries only once they've
+// been requested a second time, within window of the previous request.
+// Until then they're cold: served, but not refreshed.  Registered
+// entries are never cold.  Zero, the default, refreshes all entries.
+// It must be called before Run.
+func (k *Keep) SetPromotionWindow(window time.Duration) {
+	k.promotionWindow = window
+}
+
+// SetCacheableHeader makes the keep check the response header name of
+// every fetch.  If it's false, as parsed by strconv.ParseBool, the
+// data is served but not cached, and the path is not kept.  By default
+// no header is checked.  It must be called before Run.
+func (k *Keep) SetCacheableHeader(name string) {
+	k.cacheableHeader = name
+}
+
+func isCacheable(value string) bool {
+	cacheable, err := strconv.ParseBool(value)
+	return err != nil || cacheable
+}
+
+// SetEmptyBodyPolicy sets how empty upstream bodies are handled.  The
+// default is EmptyBodyServe.  It must be called before Run.
+func (k *Keep) SetEmptyBodyPolicy(policy EmptyBodyPolicy) {
+	k.emptyBodyPolicy = policy
+}
+
+// EmptyBodyPolicy returns how empty upstream bodies are handled.
+func (k *Keep) EmptyBodyPolicy() EmptyBodyPolicy {
+	return k.emptyBodyPolicy
+}
+
 // NewKeep returns a new keep.  expireDuration is the time an entry
 // takes to be refetched by the keep.  numExpiresToDecay is the number
-// of refetches it takes for the entry count to degrade by one.
+// of refetches it takes for the entry count to degrade by one.  A nil
+// c is a NopCache without an upstream.
 func NewKeep(c Cache, expireDuration time.Duration, numExpiresToDecay int, durationThreshold time.Duration) *Keep {
+	if c == nil {
+		c = NopCache{}
+	}
+	closed, closeWrites := context.WithCancel(context.Background())
 	return &Keep{cache: c,
+		closed:            closed,
+		closeWrites:       closeWrites,
 		entries:           make(map[string]*entry),
 		messageChannel:    make(chan keepMessage),
 		expireDuration:    expireDuration,
+		refreshInterval:   expireDuration,
+		strippedHeaders:   headerSet(defaultStrippedHeaders),
+		evictionPolicy:    EvictLRU,
+		maxVariants:       DefaultMaxVariants,
+		stats:             Stats{ResponseSizes: newHistogram(DefaultSizeBounds), FetchDurations: newHistogram(DurationBounds)},
 		numExpiresToDecay: numExpiresToDecay,
 		durationThreshold: durationThreshold}
 }
@@ -0,0 +1,78 @@
+package keep
+
+import (
+	"fmt"
+	"time"
+)
+
+type listByLabelKeepMessage struct {
+	key     string
+	value   string
+	channel chan<- EntryInfo
+}
+
+type invalidateByLabelKeepMessage struct {
+	key   string
+	value string
+}
+
+func (k *Keep) sendListByLabelKeepMessage(key string, value string, channel chan<- EntryInfo) {
+	msg := listByLabelKeepMessage{key: key, value: value, channel: channel}
+	k.messageChannel <- &msg
+}
+
+func (k *Keep) sendInvalidateByLabelKeepMessage(key string, value string) {
+	msg := invalidateByLabelKeepMessage{key: key, value: value}
+	k.messageChannel <- &msg
+}
+
+func (ei EntryInfo) hasLabel(key string, value string) bool {
+	v, ok := ei.Labels[key]
+	return ok && v == value
+}
+
+func (msg *listByLabelKeepMessage) process(k *Keep) {
+	for _, e := range k.entries {
+		if e.info.hasLabel(msg.key, msg.value) {
+			msg.channel <- e.info
+		}
+	}
+	close(msg.channel)
+}
+
+func (msg *invalidateByLabelKeepMessage) process(k *Keep) {
+	if k.readOnly {
+		fmt.Printf("not invalidating in read-only mode\n")
+		return
+	}
+	for _, e := range k.entries {
+		if !e.info.hasLabel(msg.key, msg.value) {
+			continue
+		}
+		fmt.Printf("invalidating %s\n", e.info.Path)
+		k.dropData(e)
+		if !e.info.Fetching {
+			e.info.LastFetched = time.Time{}
+			k.reschedule(e)
+		}
+	}
+}
+
+// ListByLabel returns the entries whose label key is value.  They are
+// not sorted.
+func (k *Keep) ListByLabel(key string, value string) []EntryInfo {
+	c := make(chan EntryInfo)
+	k.sendListByLabelKeepMessage(key, value, c)
+
+	var infos []EntryInfo
+	for ei := range c {
+		infos = append(infos, ei)
+	}
+	return infos
+}
+
+// InvalidateByLabel deletes the data of the entries whose label key is
+// value from the cache, and has them refetched.
+func (k *Keep) InvalidateByLabel(key string, value string) {
+	k.sendInvalidateByLabelKeepMessage(key, value)
+}
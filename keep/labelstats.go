@@ -0,0 +1,85 @@
+package keep
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// OtherLabelValue replaces label values beyond the limit of distinct
+// values in LabelStats.
+const OtherLabelValue = "other"
+
+var labelKeyPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// LabelStats are the fetch statistics of the entries with the same
+// values for the label keys set with SetStatsLabels.
+type LabelStats struct {
+	// Labels must not be modified.
+	Labels        map[string]string
+	Fetches       int
+	FetchErrors   int
+	FetchDuration time.Duration
+}
+
+// SetStatsLabels makes Stats aggregate fetches by the values of the
+// label keys.  Entries without a label have an empty value for it.  To
+// bound the number of series, only the first maxValues distinct values
+// of each key are kept apart, and the others are counted under
+// OtherLabelValue.  The keys must be valid Prometheus label names.  It
+// must be called before Run.
+func (k *Keep) SetStatsLabels(keys []string, maxValues int) error {
+	for _, key := range keys {
+		if !labelKeyPattern.MatchString(key) {
+			return errors.New("Invalid label key " + key)
+		}
+	}
+	k.statsLabelKeys = keys
+	k.maxLabelValues = maxValues
+	k.labelValues = make(map[string]map[string]bool)
+	for _, key := range keys {
+		k.labelValues[key] = make(map[string]bool)
+	}
+	k.labelStats = make(map[string]*LabelStats)
+	return nil
+}
+
+// statsLabels returns the labels ei's fetches are counted under, and a
+// string identifying them.
+func (k *Keep) statsLabels(ei EntryInfo) (map[string]string, string) {
+	labels := make(map[string]string)
+	var values []string
+	for _, key := range k.statsLabelKeys {
+		value := ei.Labels[key]
+		seen := k.labelValues[key]
+		if !seen[value] {
+			if len(seen) < k.maxLabelValues {
+				seen[value] = true
+			} else {
+				value = OtherLabelValue
+			}
+		}
+		labels[key] = value
+		values = append(values, value)
+	}
+	return labels, strings.Join(values, "\x00")
+}
+
+func (k *Keep) countLabelStats(ei EntryInfo, result fetchResult) {
+	if len(k.statsLabelKeys) == 0 {
+		return
+	}
+
+	labels, id := k.statsLabels(ei)
+	ls, ok := k.labelStats[id]
+	if !ok {
+		ls = &LabelStats{Labels: labels}
+		k.labelStats[id] = ls
+	}
+	ls.Fetches++
+	if result.Err != nil {
+		ls.FetchErrors++
+	}
+	ls.FetchDuration += result.duration
+}
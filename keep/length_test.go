@@ -0,0 +1,68 @@
+package keep
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTruncatedBody(t *testing.T) {
+	c := newStreamCache()
+	c.setSized("/a", "complete", len("complete"))
+	k := newTestKeep(c, func(k *Keep) { k.SetCheckLengths(true) })
+
+	if result := request(k, "/a"); result.err != nil {
+		t.Fatal(result.err)
+	}
+	waitWritten(t, k, "/a")
+
+	// The refresh comes up short, so the data stays stale.
+	c.setSized("/a", "compl", len("complete"))
+	k.Refresh("/a")
+	eventually(t, "the refresh to fail", func() bool {
+		ei, _ := entryInfo(k, "/a")
+		return ei.LastErr == ErrTruncated && !ei.Fetching
+	})
+	if data, _ := c.stored("/a"); data != "complete" {
+		t.Errorf("cached %q", data)
+	}
+
+	// Bodies without a Content-Length aren't checked.
+	if result := request(k, "/b"); result.err != nil {
+		t.Fatal(result.err)
+	}
+	c.setSized("/long", "too long", 3)
+	if result := request(k, "/long"); result.err != ErrTruncated {
+		t.Errorf("got %+v for a body longer than its Content-Length", result)
+	}
+}
+
+func TestTruncatedBodyUnchecked(t *testing.T) {
+	c := newStreamCache()
+	c.setSized("/a", "compl", len("complete"))
+	k := newTestKeep(c, nil)
+
+	if result := request(k, "/a"); result.err != nil || result.data != "compl" {
+		t.Fatalf("got %+v", result)
+	}
+	waitWritten(t, k, "/a")
+	if data, _ := c.stored("/a"); data != "compl" {
+		t.Errorf("cached %q", data)
+	}
+}
+
+func TestTruncatedStream(t *testing.T) {
+	c := newStreamCache()
+	large := strings.Repeat("x", 100)
+	c.setSized("/large", large[:60], len(large))
+	k := newTestKeep(c, func(k *Keep) {
+		k.SetCheckLengths(true)
+		k.SetStreamThreshold(50)
+	})
+
+	if result := request(k, "/large"); result.err != ErrTruncated {
+		t.Errorf("got %+v", result)
+	}
+	if _, ok := c.stored("/large"); ok {
+		t.Error("the cache kept a truncated stream")
+	}
+}
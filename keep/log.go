@@ -0,0 +1,30 @@
+package keep
+
+// A Logger receives the keep's log output.  *log.Logger is one.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// LogLevel is the verbosity of logging.
+type LogLevel int
+
+const (
+	// LogQuiet logs nothing to the logger.
+	LogQuiet LogLevel = iota
+	// LogDebug logs every refresh and eviction decision.
+	LogDebug
+)
+
+// SetLogger makes the keep log to logger at level.  By default nothing
+// is logged to a logger.  It must be called before Run.
+func (k *Keep) SetLogger(logger Logger, level LogLevel) {
+	k.logger = logger
+	k.debug = logger != nil && level >= LogDebug
+}
+
+func (k *Keep) debugf(format string, v ...interface{}) {
+	if !k.debug {
+		return
+	}
+	k.logger.Printf(format, v...)
+}
@@ -0,0 +1,88 @@
+package keep
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+type namespacedCache struct {
+	c      Cache
+	prefix string
+}
+
+// NewNamespacedCache returns a cache that stores data in c under keys
+// starting with prefix, so that keeps for different upstreams can share
+// one cache.  Fetches from the upstream are not affected.
+func NewNamespacedCache(c Cache, prefix string) Cache {
+	return namespacedCache{c: c, prefix: prefix}
+}
+
+func (c namespacedCache) Fetch(path string) (io.ReadCloser, error) {
+	return c.c.Fetch(path)
+}
+
+func (c namespacedCache) Get(path string) ([]byte, error) {
+	return c.c.Get(c.prefix + path)
+}
+
+func (c namespacedCache) Set(path string, data []byte) error {
+	return c.c.Set(c.prefix+path, data)
+}
+
+func (c namespacedCache) Delete(path string) error {
+	return c.c.Delete(c.prefix + path)
+}
+
+func (c namespacedCache) FetchEncoded(path string, encoding string) (io.ReadCloser, string, error) {
+	vc, ok := c.c.(VariantCache)
+	if !ok {
+		return nil, "", errors.New("Cache does not support encoded variants")
+	}
+	return vc.FetchEncoded(path, encoding)
+}
+
+func (c namespacedCache) Validator(path string) (string, error) {
+	vc, ok := c.c.(ValidatingCache)
+	if !ok {
+		return "", errors.New("Cache does not support validators")
+	}
+	return vc.Validator(path)
+}
+
+func (c namespacedCache) ValidatorContext(ctx context.Context, path string) (string, error) {
+	vc, ok := c.c.(ValidatingCache)
+	if !ok {
+		return "", errors.New("Cache does not support validators")
+	}
+	return fetchValidator(ctx, vc, path)
+}
+
+func (c namespacedCache) FetchContext(ctx context.Context, path string) (io.ReadCloser, error) {
+	cc, ok := c.c.(ContextCache)
+	if !ok {
+		return c.c.Fetch(path)
+	}
+	return cc.FetchContext(ctx, path)
+}
+
+func (c namespacedCache) SetContext(ctx context.Context, path string, data []byte) error {
+	cw, ok := c.c.(ContextWriter)
+	if !ok {
+		return c.Set(path, data)
+	}
+	return cw.SetContext(ctx, c.prefix+path, data)
+}
+
+func (c namespacedCache) SetStream(path string, r io.Reader, size int64) error {
+	sc, ok := c.c.(StreamCache)
+	if !ok {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return c.Set(path, data)
+	}
+	return sc.SetStream(c.prefix+path, r, size)
+}
@@ -0,0 +1,43 @@
+package keep
+
+import "testing"
+
+func TestNamespacedKeeps(t *testing.T) {
+	shared := newTestCache()
+	a := NewNamespacedCache(shared, "a:")
+	b := NewNamespacedCache(shared, "b:")
+	ka := newTestKeep(a, nil)
+	kb := newTestKeep(b, nil)
+
+	if err := ka.Prime("/items"); err != nil {
+		t.Fatal(err)
+	}
+	waitWritten(t, ka, "/items")
+	if _, ok := shared.stored("a:/items"); !ok {
+		t.Error("not stored in the namespace")
+	}
+	if _, err := b.Get("/items"); err == nil {
+		t.Error("the other namespace sees the data")
+	}
+
+	shared.setBody("/items", "other")
+	if err := kb.Prime("/items"); err != nil {
+		t.Fatal(err)
+	}
+	waitWritten(t, kb, "/items")
+	if data, err := a.Get("/items"); err != nil || string(data) != "data /items" {
+		t.Errorf("got %q, %v", data, err)
+	}
+	if data, err := b.Get("/items"); err != nil || string(data) != "other" {
+		t.Errorf("got %q, %v", data, err)
+	}
+
+	ka.Unregister("/items")
+	eventually(t, "the data to be deleted", func() bool {
+		_, ok := shared.stored("a:/items")
+		return !ok
+	})
+	if data, _ := shared.stored("b:/items"); data != "other" {
+		t.Errorf("deleted from the other namespace, which has %q", data)
+	}
+}
@@ -0,0 +1,41 @@
+package keep
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrNotStored is returned by the Get of a NopCache.
+var ErrNotStored = errors.New("Data is not stored")
+
+// ErrNoUpstream is returned by the Fetch of a NopCache without a
+// FetchFunc.
+var ErrNoUpstream = errors.New("No upstream to fetch from")
+
+// A NopCache fetches from the upstream with FetchFunc, but doesn't
+// store anything, so that a keep can run without a backend.  Every
+// request for a path is a miss that's fetched, or waits for a fetch
+// that's already running.  Without a FetchFunc, fetches fail with
+// ErrNoUpstream.  A keep made with a nil Cache uses one of those.
+type NopCache struct {
+	FetchFunc func(path string) (io.ReadCloser, error)
+}
+
+func (c NopCache) Fetch(path string) (io.ReadCloser, error) {
+	if c.FetchFunc == nil {
+		return nil, ErrNoUpstream
+	}
+	return c.FetchFunc(path)
+}
+
+func (c NopCache) Get(path string) ([]byte, error) {
+	return nil, ErrNotStored
+}
+
+func (c NopCache) Set(path string, data []byte) error {
+	return nil
+}
+
+func (c NopCache) Delete(path string) error {
+	return nil
+}
@@ -0,0 +1,49 @@
+package keep
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNilCache(t *testing.T) {
+	k := newTestKeep(nil, nil)
+
+	for i := 0; i < 2; i++ {
+		if result := request(k, "/a"); result.err != ErrNoUpstream {
+			t.Errorf("request %d got %q, %v", i, result.data, result.err)
+		}
+		eventually(t, "the fetch to finish", notFetching(k, "/a"))
+	}
+	if err := k.Prime("/a"); err != ErrNoUpstream {
+		t.Errorf("prime got %v", err)
+	}
+	if ei, _ := entryInfo(k, "/a"); ei.LastErr != ErrNoUpstream {
+		t.Errorf("entry has error %v", ei.LastErr)
+	}
+}
+
+func TestNopCache(t *testing.T) {
+	var fetches int32
+	fetch := func(path string) (io.ReadCloser, error) {
+		atomic.AddInt32(&fetches, 1)
+		return ioutil.NopCloser(strings.NewReader("data " + path)), nil
+	}
+	k := newTestKeep(NopCache{FetchFunc: fetch}, nil)
+
+	// Nothing is stored, so every request fetches.
+	for i := 0; i < 3; i++ {
+		if result := request(k, "/a"); result.err != nil || result.data != "data /a" {
+			t.Errorf("request %d got %q, %v", i, result.data, result.err)
+		}
+		eventually(t, "the fetch to finish", notFetching(k, "/a"))
+	}
+	if _, err := (NopCache{FetchFunc: fetch}).Get("/a"); err != ErrNotStored {
+		t.Errorf("got %v from Get", err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 3 {
+		t.Errorf("%d fetches, want 3", n)
+	}
+}
@@ -0,0 +1,55 @@
+package keep
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrPaused is returned for data that would have to be fetched while
+// refreshing is paused, if fetches are blocked then.
+var ErrPaused = errors.New("Keep is paused")
+
+type pauseKeepMessage struct {
+	paused bool
+}
+
+func (k *Keep) sendPauseKeepMessage(paused bool) {
+	msg := pauseKeepMessage{paused: paused}
+	k.messageChannel <- &msg
+}
+
+func (msg *pauseKeepMessage) process(k *Keep) {
+	if msg.paused {
+		fmt.Printf("pausing refreshes\n")
+		atomic.StoreInt32(&k.paused, 1)
+		k.stopTimer()
+	} else {
+		fmt.Printf("resuming refreshes\n")
+		atomic.StoreInt32(&k.paused, 0)
+	}
+}
+
+// Pause stops all refreshes until Resume is called.  Data in the cache
+// is still served, however stale.
+func (k *Keep) Pause() {
+	k.sendPauseKeepMessage(true)
+}
+
+// Resume resumes refreshes after Pause.  Entries that expired in the
+// meantime are refreshed right away.
+func (k *Keep) Resume() {
+	k.sendPauseKeepMessage(false)
+}
+
+// Paused returns whether refreshes are paused.
+func (k *Keep) Paused() bool {
+	return atomic.LoadInt32(&k.paused) != 0
+}
+
+// SetPauseBlocksFetches makes WaitOrFetch and Prime return ErrPaused
+// while refreshes are paused, instead of fetching data that's missing.
+// It must be called before Run.
+func (k *Keep) SetPauseBlocksFetches(block bool) {
+	k.pauseBlocksFetches = block
+}
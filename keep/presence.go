@@ -0,0 +1,83 @@
+package keep
+
+import (
+	"fmt"
+	"time"
+)
+
+type presenceSample struct {
+	path string
+	etag string
+}
+
+type samplePresenceKeepMessage struct {
+	n     int
+	reply chan<- []presenceSample
+}
+
+type lostKeepMessage struct {
+	sample presenceSample
+}
+
+func (k *Keep) sendSamplePresenceKeepMessage(n int, reply chan<- []presenceSample) {
+	msg := samplePresenceKeepMessage{n: n, reply: reply}
+	k.messageChannel <- &msg
+}
+
+func (k *Keep) sendLostKeepMessage(sample presenceSample) {
+	msg := lostKeepMessage{sample: sample}
+	k.messageChannel <- &msg
+}
+
+func (msg *samplePresenceKeepMessage) process(k *Keep) {
+	var samples []presenceSample
+	// Map iteration order is random enough for sampling.
+	for _, e := range k.entries {
+		if len(samples) >= msg.n {
+			break
+		}
+		if e.info.Fetching || e.etag == "" {
+			continue
+		}
+		samples = append(samples, presenceSample{path: e.info.Path, etag: e.etag})
+	}
+	msg.reply <- samples
+}
+
+func (msg *lostKeepMessage) process(k *Keep) {
+	e, ok := k.entries[msg.sample.path]
+	// If the data changed since it was sampled, it was just
+	// written again.
+	if !ok || e.info.Fetching || e.etag != msg.sample.etag {
+		return
+	}
+	fmt.Printf("%s is not in the cache anymore\n", e.info.Path)
+	e.etag = ""
+	e.header = nil
+	k.setSize(e, 0)
+	k.stats.Lost++
+}
+
+// SetPresenceCheck makes the keep check every interval whether the data
+// of up to n entries is still in the cache, for caches shared with
+// other processes that might delete it.  Entries whose data is gone are
+// treated as having none until they're fetched again.  Any error from
+// Cache.Get counts as the data being gone.  A zero interval, the
+// default, disables the check.  It must be called before Run.
+func (k *Keep) SetPresenceCheck(interval time.Duration, n int) {
+	k.presenceInterval = interval
+	k.presenceSamples = n
+}
+
+func (k *Keep) checkPresence() {
+	for range time.Tick(k.presenceInterval) {
+		c := make(chan []presenceSample, 1)
+		k.sendSamplePresenceKeepMessage(k.presenceSamples, c)
+		for _, sample := range <-c {
+			_, err := k.cache.Get(sample.path)
+			if err != nil {
+				k.sendLostKeepMessage(sample)
+			}
+		}
+	}
+}
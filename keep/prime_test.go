@@ -0,0 +1,47 @@
+package keep
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrime(t *testing.T) {
+	c := newTestCache()
+	k := newTestKeep(c, nil)
+
+	if err := k.Prime("/a"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the data to be cached", func() bool {
+		_, ok := c.stored("/a")
+		return ok
+	})
+}
+
+func TestPrimeNotCached(t *testing.T) {
+	c := newTestCache()
+	hook := newWaiterHook()
+	k := NewKeep(c, time.Hour, 5, time.Hour)
+	k.SetOnWaiter(hook.onWaiter)
+	go k.Run()
+
+	if err := k.Prime("/a"); err != ErrNotCached {
+		t.Errorf("got %v for a fetch under the threshold", err)
+	}
+
+	// A prime that waits for a running fetch is told, too.
+	c.hold("/b")
+	results := startRequests(k, "/b", 1)
+	waitStarted(t, c, "/b")
+	primed := make(chan error, 1)
+	go func() { primed <- k.Prime("/b") }()
+	hook.wait(t, 1)
+	c.release("/b")
+	collect(t, results)
+	if err := <-primed; err != ErrNotCached {
+		t.Errorf("got %v waiting for a fetch under the threshold", err)
+	}
+	if _, ok := c.stored("/b"); ok {
+		t.Error("cached a fetch under the threshold")
+	}
+}
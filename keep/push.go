@@ -0,0 +1,117 @@
+package keep
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type pushedKeepMessage struct {
+	path        string
+	data        []byte
+	etag        string
+	contentType string
+}
+
+func (k *Keep) sendPushedKeepMessage(path string, data []byte, etag string, contentType string) {
+	msg := pushedKeepMessage{path: path, data: data, etag: etag, contentType: contentType}
+	k.messageChannel <- &msg
+}
+
+// A pushingKeepMessage tells the loop that data for path is about to be
+// pushed.  Fetches that are running can't write their data anymore, and
+// the reply comes once the writes that started are done, so that they
+// can't overwrite the pushed data.
+type pushingKeepMessage struct {
+	path  string
+	reply chan<- bool
+}
+
+func (k *Keep) sendPushingKeepMessage(path string, reply chan<- bool) {
+	msg := pushingKeepMessage{path: path, reply: reply}
+	k.messageChannel <- &msg
+}
+
+func (msg *pushingKeepMessage) process(k *Keep) {
+	e, ok := k.entries[msg.path]
+	if !ok {
+		msg.reply <- true
+		return
+	}
+	e.pushes++
+	if e.writes == 0 {
+		msg.reply <- true
+		return
+	}
+	e.pushWaiters = append(e.pushWaiters, msg.reply)
+}
+
+func (msg *pushedKeepMessage) process(k *Keep) {
+	path := msg.path
+
+	e, ok := k.entries[path]
+	if !ok {
+		e = &entry{info: EntryInfo{Path: path,
+			Count:     k.numExpiresToDecay,
+			Cold:      k.promotionWindow > 0,
+			Immutable: k.matchesImmutable(path)}}
+		k.entries[path] = e
+	}
+
+	e.info.LastFetched = time.Now()
+	e.info.LastErr = nil
+	e.info.LastErrTime = time.Time{}
+	e.etag = msg.etag
+	e.validator = ""
+	if msg.contentType != "" {
+		header := make(http.Header)
+		for name, values := range e.header {
+			header[name] = values
+		}
+		header.Set("Content-Type", msg.contentType)
+		e.header = header
+	}
+	k.setSize(e, len(msg.data))
+	e.fetches++
+	if k.debug {
+		k.debugf("PUSH %s, %d bytes", path, len(msg.data))
+	}
+
+	result := fetchResult{Data: msg.data, etag: msg.etag}
+	k.notifyWaiters(e, result)
+	k.notifyTokenWaiters(e, result)
+	// Whatever a running refresh gets is older than the pushed
+	// data.
+	k.abandon(e)
+	k.evict(e)
+	k.reschedule(e)
+}
+
+// Set pushes data for path into the cache, as if it had just been
+// fetched, without fetching it from the upstream.  The path is added to
+// the keep if it's not in it yet, and requests waiting for a fetch of
+// it get data.  If contentType is given, it's served with the data
+// until the next fetch replaces the headers.  Encoded variants are
+// deleted, because they would be outdated.  A refresh running at the
+// same time is abandoned if possible, and the result of any fetch that
+// started before is dropped.
+func (k *Keep) Set(path string, data []byte, contentType string) error {
+	if k.readOnly {
+		return ErrReadOnly
+	}
+
+	c := make(chan bool, 1)
+	k.sendPushingKeepMessage(path, c)
+	<-c
+
+	for _, encoding := range k.encodings {
+		k.cache.Delete(VariantKey(path, encoding))
+	}
+	err := k.setData(path, data)
+	if err != nil {
+		fmt.Printf("cache set error\n")
+		return err
+	}
+	k.sendPushedKeepMessage(path, data, k.computeETag(data), contentType)
+	return nil
+}
@@ -0,0 +1,120 @@
+package keep
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPush(t *testing.T) {
+	c := newTestCache()
+	k := newTestKeep(c, func(k *Keep) { k.SetReplayHeaders([]string{"Content-Type"}) })
+
+	if err := k.Set("/a", []byte("pushed"), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := c.stored("/a"); data != "pushed" {
+		t.Errorf("cached %q", data)
+	}
+	if !k.Contains("/a") {
+		t.Error("pushed path isn't kept")
+	}
+	if etag := k.ETag("/a"); etag != k.computeETag([]byte("pushed")) {
+		t.Errorf("got ETag %s", etag)
+	}
+	if contentType := k.Header("/a").Get("Content-Type"); contentType != "text/plain" {
+		t.Errorf("got Content-Type %q", contentType)
+	}
+	if n := c.fetchCount("/a"); n != 0 {
+		t.Errorf("%d upstream fetches", n)
+	}
+}
+
+func TestPushDuringRequestFetch(t *testing.T) {
+	c := newTestCache()
+	k := newTestKeep(c, nil)
+
+	c.hold("/a")
+	results := startRequests(k, "/a", 1)
+	waitStarted(t, c, "/a")
+
+	// The fetch read the upstream before the push, so its result
+	// is older than the pushed data.
+	if err := k.Set("/a", []byte("pushed"), ""); err != nil {
+		t.Fatal(err)
+	}
+	c.release("/a")
+	collect(t, results)
+	eventually(t, "the fetch to finish", notFetching(k, "/a"))
+	waitWritten(t, k, "/a")
+
+	if data, _ := c.stored("/a"); data != "pushed" {
+		t.Errorf("the fetch overwrote the pushed data with %q", data)
+	}
+	if n := c.setCount("/a"); n != 1 {
+		t.Errorf("%d writes, want the push's only", n)
+	}
+	ei, _ := entryInfo(k, "/a")
+	if ei.Size != len("pushed") {
+		t.Errorf("got size %d", ei.Size)
+	}
+	if etag := k.ETag("/a"); etag != k.computeETag([]byte("pushed")) {
+		t.Errorf("got ETag %s", etag)
+	}
+
+	// Fetches that start after the push replace the data.
+	c.setBody("/a", "fetched")
+	token := k.Refresh("/a")
+	if data := readToken(t, k, c, "/a", token); data != "fetched" {
+		t.Errorf("refresh after the push read %q", data)
+	}
+}
+
+// waitPrimed waits for a prime that was sent to primed.
+func waitPrimed(t *testing.T, primed chan error) error {
+	t.Helper()
+	select {
+	case err := <-primed:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a prime")
+	}
+	return nil
+}
+
+func TestPushDuringPrime(t *testing.T) {
+	c := newTestCache()
+	hook := newWaiterHook()
+	k := newTestKeep(c, func(k *Keep) { k.SetOnWaiter(hook.onWaiter) })
+	prime := func() chan error {
+		primed := make(chan error, 1)
+		go func() { primed <- k.Prime("/a") }()
+		return primed
+	}
+
+	c.hold("/a")
+	fetching := prime()
+	waitStarted(t, c, "/a")
+	// A prime waiting when the data is pushed gets it.
+	before := prime()
+	hook.wait(t, 1)
+	if err := k.Set("/a", []byte("pushed"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitPrimed(t, before); err != nil {
+		t.Errorf("prime waiting for the push got %v", err)
+	}
+
+	// Those waiting for the fetch don't prime anything, because the
+	// push replaced its data.
+	after := prime()
+	hook.wait(t, 1)
+	c.release("/a")
+	for _, primed := range []chan error{fetching, after} {
+		if err := waitPrimed(t, primed); err != ErrNotCached {
+			t.Errorf("prime got %v for data that wasn't cached", err)
+		}
+	}
+	if data, _ := c.stored("/a"); data != "pushed" {
+		t.Errorf("cached %q", data)
+	}
+}
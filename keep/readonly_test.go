@@ -0,0 +1,35 @@
+package keep
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReadOnly(t *testing.T) {
+	c := newTestCache()
+	c.Set("/a", []byte("frozen"))
+	k := NewKeep(c, 10*time.Millisecond, 5, 0)
+	k.SetReadOnly(true)
+	go k.Run()
+
+	if result := request(k, "/b"); result.err != ErrReadOnly {
+		t.Errorf("got %+v for a missing path", result)
+	}
+	if err := k.Prime("/b"); err != ErrReadOnly {
+		t.Errorf("got %v priming", err)
+	}
+
+	k.RegisterWithLabels("/a", map[string]string{"team": "search"})
+	time.Sleep(50 * time.Millisecond)
+	k.InvalidateByLabel("team", "search")
+	k.Unregister("/a")
+	if _, ok := entryInfo(k, "/a"); !ok {
+		t.Error("unregistered a path")
+	}
+	if data, ok := c.stored("/a"); !ok || data != "frozen" {
+		t.Errorf("cache has %q, %v", data, ok)
+	}
+	if n := c.fetchCount("/a") + c.fetchCount("/b"); n != 0 {
+		t.Errorf("%d fetches", n)
+	}
+}
@@ -0,0 +1,86 @@
+package keep
+
+import "fmt"
+
+type registerKeepMessage struct {
+	path   string
+	labels map[string]string
+}
+
+type unregisterKeepMessage struct {
+	path string
+}
+
+func (k *Keep) sendRegisterKeepMessage(path string, labels map[string]string) {
+	msg := registerKeepMessage{path: path, labels: labels}
+	k.messageChannel <- &msg
+}
+
+func (k *Keep) sendUnregisterKeepMessage(path string) {
+	msg := unregisterKeepMessage{path: path}
+	k.messageChannel <- &msg
+}
+
+// stopTimer makes the run loop reschedule, for when an entry's expire
+// time moved earlier.
+func (k *Keep) stopTimer() {
+	if k.timer != nil {
+		k.timer.Stop()
+		k.timer = nil
+	}
+}
+
+func (msg *registerKeepMessage) process(k *Keep) {
+	path := msg.path
+
+	e, ok := k.entries[path]
+	if !ok {
+		// A zero LastFetched makes the entry expire right away, so
+		// it's fetched on the next pass.
+		e = &entry{info: EntryInfo{Path: path, Immutable: k.matchesImmutable(path)}}
+		k.entries[path] = e
+	}
+
+	e.info.Pinned = true
+	e.info.Cold = false
+	if msg.labels != nil {
+		e.info.Labels = msg.labels
+	}
+	if e.info.Count < k.numExpiresToDecay {
+		e.info.Count = k.numExpiresToDecay
+	}
+	k.reschedule(e)
+}
+
+func (msg *unregisterKeepMessage) process(k *Keep) {
+	e, ok := k.entries[msg.path]
+	if !ok || k.readOnly {
+		return
+	}
+
+	e.info.Pinned = false
+	e.info.Count = 0
+	fmt.Printf("deleting %s\n", e.info.Path)
+	k.abandon(e)
+	k.dropData(e)
+	k.reschedule(e)
+}
+
+// Register adds path to the keep as a pinned entry, which is fetched
+// right away if it's not in the keep yet and then kept warm without
+// decaying.
+func (k *Keep) Register(path string) {
+	k.sendRegisterKeepMessage(path, nil)
+}
+
+// RegisterWithLabels registers path like Register, and sets its labels,
+// which can be used to operate on groups of entries.  The keep takes
+// ownership of labels.
+func (k *Keep) RegisterWithLabels(path string, labels map[string]string) {
+	k.sendRegisterKeepMessage(path, labels)
+}
+
+// Unregister stops keeping path warm and deletes it from the cache.
+func (k *Keep) Unregister(path string) {
+	k.sendUnregisterKeepMessage(path)
+}
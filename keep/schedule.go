@@ -0,0 +1,190 @@
+package keep
+
+import (
+	"container/heap"
+	"time"
+)
+
+// The schedule is a min-heap of the times entries are due to be
+// refetched.  An entry's item is only valid if its due time is the
+// entry's due time: when an entry's expire time changes it's pushed
+// again instead of fixing the heap, and invalid items are dropped when
+// they reach the top.  Entries that are being fetched or have decayed
+// are not scheduled until they're eligible again, and immutable
+// entries are not scheduled once they're fetched.  Neither are cold
+// entries.  With per-entry timers, the same rules apply to the timers
+// instead, and entries are queued once they're due.
+type scheduleItem struct {
+	e   *entry
+	due time.Time
+}
+
+type schedule []scheduleItem
+
+func (s schedule) Len() int {
+	return len(s)
+}
+
+func (s schedule) Less(i, j int) bool {
+	return s[i].due.Before(s[j].due)
+}
+
+func (s schedule) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s *schedule) Push(x interface{}) {
+	*s = append(*s, x.(scheduleItem))
+}
+
+func (s *schedule) Pop() interface{} {
+	old := *s
+	item := old[len(old)-1]
+	*s = old[:len(old)-1]
+	return item
+}
+
+func (item scheduleItem) valid() bool {
+	e := item.e
+	return item.due.Equal(e.due) && e.schedulable()
+}
+
+func (e *entry) schedulable() bool {
+	return !e.info.Fetching && e.info.Count > 0 && !e.settled() && !e.info.Cold
+}
+
+// reschedule schedules e for its current expire time, for when it
+// changed or e became eligible for refetching.
+func (k *Keep) reschedule(e *entry) {
+	if !e.schedulable() {
+		e.due = time.Time{}
+		k.stopEntryTimer(e)
+		return
+	}
+	due := k.expireTime(e.info)
+	if due.Equal(e.due) {
+		return
+	}
+	e.due = due
+	if k.perEntryTimers {
+		k.startEntryTimer(e)
+		return
+	}
+	heap.Push(&k.schedule, scheduleItem{e: e, due: due})
+	if k.timer != nil && due.Before(k.timerDue) {
+		k.stopTimer()
+	}
+}
+
+// rescheduleAll rebuilds the schedule from scratch, for when the expire
+// times of many entries changed, or some moved earlier.
+func (k *Keep) rescheduleAll() {
+	if k.perEntryTimers {
+		k.due = nil
+		for _, e := range k.entries {
+			e.due = time.Time{}
+			k.stopEntryTimer(e)
+			k.reschedule(e)
+		}
+		return
+	}
+	k.schedule = make(schedule, 0, len(k.entries))
+	for _, e := range k.entries {
+		e.due = time.Time{}
+		if !e.schedulable() {
+			continue
+		}
+		e.due = k.expireTime(e.info)
+		k.schedule = append(k.schedule, scheduleItem{e: e, due: e.due})
+	}
+	heap.Init(&k.schedule)
+	k.stopTimer()
+}
+
+// nextDue returns the first entry due to be refetched, dropping invalid
+// items, and moving entries whose expire time is later than scheduled.
+func (k *Keep) nextDue() (*entry, bool) {
+	if k.perEntryTimers {
+		return k.nextDueEntry()
+	}
+	for len(k.schedule) > 0 {
+		item := k.schedule[0]
+		if !item.valid() {
+			heap.Pop(&k.schedule)
+			if item.due.Equal(item.e.due) {
+				// It has to be pushed again once it's
+				// eligible.
+				item.e.due = time.Time{}
+			}
+			continue
+		}
+		due := k.expireTime(item.e.info)
+		if due.After(item.due) {
+			heap.Pop(&k.schedule)
+			item.e.due = time.Time{}
+			k.reschedule(item.e)
+			continue
+		}
+		return item.e, true
+	}
+	return nil, false
+}
+
+// popDue removes e, which nextDue returned, from the schedule.
+func (k *Keep) popDue(e *entry) {
+	if k.perEntryTimers {
+		k.due = k.due[1:]
+	} else {
+		heap.Pop(&k.schedule)
+	}
+	e.due = time.Time{}
+}
+
+// nextRefresh returns when e will be refreshed, as the schedule sees
+// it, or false if it won't be until something changes.  The refresh
+// might still be skipped for other instances, or throttled.
+func (k *Keep) nextRefresh(e *entry) (time.Time, bool) {
+	if !e.schedulable() || k.readOnly || k.Paused() {
+		return time.Time{}, false
+	}
+	next := k.expireTime(e.info)
+	if next.Before(k.refreshStart) {
+		next = k.refreshStart
+	}
+	if k.breakerState == breakerOpen && next.Before(k.breakerOpenUntil) {
+		next = k.breakerOpenUntil
+	}
+	return next, true
+}
+
+type nextRefreshKeepMessage struct {
+	path  string
+	reply chan<- time.Time
+}
+
+func (k *Keep) sendNextRefreshKeepMessage(path string, reply chan<- time.Time) {
+	msg := nextRefreshKeepMessage{path: path, reply: reply}
+	k.messageChannel <- &msg
+}
+
+func (msg *nextRefreshKeepMessage) process(k *Keep) {
+	e, ok := k.entries[msg.path]
+	if !ok {
+		msg.reply <- time.Time{}
+		return
+	}
+	next, _ := k.nextRefresh(e)
+	msg.reply <- next
+}
+
+// NextRefresh returns when path is due to be refreshed next, taking
+// into account its TTL, slowness, the start delay, the breaker and
+// pausing.  It returns false if the path is not in the keep or won't be
+// refreshed, e.g. because it's being fetched, has decayed, or is cold
+// or immutable.
+func (k *Keep) NextRefresh(path string) (time.Time, bool) {
+	c := make(chan time.Time, 1)
+	k.sendNextRefreshKeepMessage(path, c)
+	next := <-c
+	return next, !next.IsZero()
+}
@@ -0,0 +1,35 @@
+package keep
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// BenchmarkSchedule measures refetching the entry that's due next and
+// scheduling it again, as fetchExpired does, for keeps of increasing
+// size.
+func BenchmarkSchedule(b *testing.B) {
+	for _, n := range []int{100, 10000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			k := NewKeep(nil, time.Minute, 5, 0)
+			start := time.Now()
+			for i := 0; i < n; i++ {
+				path := fmt.Sprintf("/%d", i)
+				e := &entry{info: EntryInfo{Path: path, Count: 1, LastFetched: start.Add(time.Duration(i) * time.Microsecond)}}
+				k.entries[path] = e
+				k.reschedule(e)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				e, ok := k.nextDue()
+				if !ok {
+					b.Fatal("nothing scheduled")
+				}
+				k.popDue(e)
+				e.info.LastFetched = e.info.LastFetched.Add(time.Minute)
+				k.reschedule(e)
+			}
+		})
+	}
+}
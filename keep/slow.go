@@ -0,0 +1,36 @@
+package keep
+
+import (
+	"fmt"
+	"time"
+)
+
+// SetSlowFetches marks entries as slow when a successful fetch takes
+// longer than threshold, until one is fast again.  Slow entries are
+// refetched factor times less often, if factor is greater than one.
+// onSlow, if not nil, is called in a new goroutine whenever an entry
+// becomes slow or fast again.  A zero threshold, the default, disables
+// this.  It must be called before Run.
+func (k *Keep) SetSlowFetches(threshold time.Duration, factor int, onSlow func(path string, slow bool)) {
+	k.slowThreshold = threshold
+	k.slowFactor = factor
+	k.onSlow = onSlow
+}
+
+func (k *Keep) updateSlow(e *entry, result fetchResult) {
+	if k.slowThreshold <= 0 || result.Err != nil {
+		return
+	}
+
+	slow := result.duration > k.slowThreshold
+	if slow == e.info.Slow {
+		return
+	}
+	if slow {
+		fmt.Printf("%s is slow\n", e.info.Path)
+	}
+	e.info.Slow = slow
+	if k.onSlow != nil {
+		go k.onSlow(e.info.Path, slow)
+	}
+}
@@ -0,0 +1,197 @@
+package keep
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// SnapshotFormat is the encoding of entry snapshots.
+type SnapshotFormat int
+
+const (
+	// SnapshotGob is compact, but only readable from Go.
+	SnapshotGob SnapshotFormat = iota
+	// SnapshotJSON is human-readable.
+	SnapshotJSON
+)
+
+// snapshotEntry holds the parts of EntryInfo that are persisted.
+type snapshotEntry struct {
+	Path         string
+	Count        int
+	LastFetched  time.Time
+	LastDuration time.Duration
+	LastErr      string
+	LastErrTime  time.Time
+	Pinned       bool
+	Labels       map[string]string
+	MaxServedAge time.Duration
+	SoftTTL      time.Duration
+	Immutable    bool
+	Cold         bool
+	// Size is the size of the data in the cache, which is taken
+	// from it instead if it's exported along with the entry.
+	Size          int
+	Requests      int
+	Weight        int
+	Hits          int
+	LastRequested time.Time
+}
+
+type snapshotCodec interface {
+	encode(w io.Writer, entries []snapshotEntry) error
+	decode(r io.Reader) ([]snapshotEntry, error)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) encode(w io.Writer, entries []snapshotEntry) error {
+	return gob.NewEncoder(w).Encode(entries)
+}
+
+func (gobCodec) decode(r io.Reader) ([]snapshotEntry, error) {
+	var entries []snapshotEntry
+	err := gob.NewDecoder(r).Decode(&entries)
+	return entries, err
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) encode(w io.Writer, entries []snapshotEntry) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(entries)
+}
+
+func (jsonCodec) decode(r io.Reader) ([]snapshotEntry, error) {
+	var entries []snapshotEntry
+	err := json.NewDecoder(r).Decode(&entries)
+	return entries, err
+}
+
+func (f SnapshotFormat) codec() (snapshotCodec, error) {
+	switch f {
+	case SnapshotGob:
+		return gobCodec{}, nil
+	case SnapshotJSON:
+		return jsonCodec{}, nil
+	}
+	return nil, fmt.Errorf("Unknown snapshot format %d", f)
+}
+
+func newSnapshotEntry(ei EntryInfo) snapshotEntry {
+	se := snapshotEntry{Path: ei.Path,
+		Count:         ei.Count,
+		LastFetched:   ei.LastFetched,
+		LastDuration:  ei.LastDuration,
+		Pinned:        ei.Pinned,
+		Labels:        ei.Labels,
+		MaxServedAge:  ei.MaxServedAge,
+		SoftTTL:       ei.SoftTTL,
+		Immutable:     ei.Immutable,
+		Cold:          ei.Cold,
+		Size:          ei.Size,
+		Requests:      ei.Requests,
+		Weight:        ei.Weight,
+		Hits:          ei.Hits,
+		LastRequested: ei.LastRequested}
+	if ei.LastErr != nil {
+		se.LastErr = ei.LastErr.Error()
+		se.LastErrTime = ei.LastErrTime
+	}
+	return se
+}
+
+type restoreKeepMessage struct {
+	entries []snapshotEntry
+	// The data of the entries in the cache, if it's there.
+	bodies [][]byte
+	// reply gets whether each entry was restored, if it's given.
+	reply chan<- []bool
+}
+
+func (k *Keep) sendRestoreKeepMessage(entries []snapshotEntry, bodies [][]byte, reply chan<- []bool) {
+	msg := restoreKeepMessage{entries: entries, bodies: bodies, reply: reply}
+	k.messageChannel <- &msg
+}
+
+func (msg *restoreKeepMessage) process(k *Keep) {
+	restored := make([]bool, len(msg.entries))
+	if msg.reply != nil {
+		defer func() { msg.reply <- restored }()
+	}
+	for i, se := range msg.entries {
+		if _, ok := k.entries[se.Path]; ok {
+			continue
+		}
+		restored[i] = true
+		info := EntryInfo{Path: se.Path,
+			Count:         se.Count,
+			LastFetched:   se.LastFetched,
+			LastDuration:  se.LastDuration,
+			Pinned:        se.Pinned,
+			Labels:        se.Labels,
+			MaxServedAge:  se.MaxServedAge,
+			SoftTTL:       se.SoftTTL,
+			Immutable:     se.Immutable,
+			Cold:          se.Cold,
+			Requests:      se.Requests,
+			Weight:        se.Weight,
+			Hits:          se.Hits,
+			LastRequested: se.LastRequested}
+		if se.LastErr != "" {
+			info.LastErr = errors.New(se.LastErr)
+			info.LastErrTime = se.LastErrTime
+		}
+		e := &entry{info: info}
+		if msg.bodies != nil {
+			e.etag = k.computeETag(msg.bodies[i])
+			k.setSize(e, len(msg.bodies[i]))
+		} else {
+			k.setSize(e, se.Size)
+		}
+		k.entries[se.Path] = e
+		k.reschedule(e)
+	}
+}
+
+// SetSnapshotFormat sets the format of snapshots.  The default is
+// SnapshotGob.  It must be called before Run.
+func (k *Keep) SetSnapshotFormat(format SnapshotFormat) {
+	k.snapshotFormat = format
+}
+
+// WriteSnapshot writes the metadata of all entries to w.  The cached
+// data is not included, for which there's Export.
+func (k *Keep) WriteSnapshot(w io.Writer) error {
+	codec, err := k.snapshotFormat.codec()
+	if err != nil {
+		return err
+	}
+
+	var entries []snapshotEntry
+	for _, ei := range k.Dump() {
+		entries = append(entries, newSnapshotEntry(ei))
+	}
+	return codec.encode(w, entries)
+}
+
+// ReadSnapshot adds the entries in a snapshot written by WriteSnapshot
+// to the keep.  Entries that are already in the keep are left alone.
+func (k *Keep) ReadSnapshot(r io.Reader) error {
+	codec, err := k.snapshotFormat.codec()
+	if err != nil {
+		return err
+	}
+
+	entries, err := codec.decode(r)
+	if err != nil {
+		return err
+	}
+	k.sendRestoreKeepMessage(entries, nil, nil)
+	return nil
+}
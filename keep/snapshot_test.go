@@ -0,0 +1,90 @@
+package keep
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testSnapshotEntries() []snapshotEntry {
+	when := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	return []snapshotEntry{
+		{Path: "/a",
+			Count:         3,
+			LastFetched:   when,
+			LastDuration:  250 * time.Millisecond,
+			LastErr:       "upstream down",
+			LastErrTime:   when.Add(time.Minute),
+			Pinned:        true,
+			Labels:        map[string]string{"team": "search"},
+			MaxServedAge:  time.Hour,
+			SoftTTL:       time.Minute,
+			Immutable:     true,
+			Cold:          true,
+			Size:          1234,
+			Requests:      17,
+			Weight:        34,
+			Hits:          12,
+			LastRequested: when.Add(2 * time.Minute)},
+		{Path: "/b?x=1", Count: 1},
+	}
+}
+
+func TestSnapshotCodecs(t *testing.T) {
+	for _, format := range []SnapshotFormat{SnapshotGob, SnapshotJSON} {
+		codec, err := format.codec()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries := testSnapshotEntries()
+		buffer := new(bytes.Buffer)
+		if err := codec.encode(buffer, entries); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		decoded, err := codec.decode(buffer)
+		if err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		if !reflect.DeepEqual(decoded, entries) {
+			t.Errorf("format %d: got\n%+v\nwant\n%+v", format, decoded, entries)
+		}
+	}
+
+	if _, err := SnapshotFormat(7).codec(); err == nil {
+		t.Error("got a codec for an unknown format")
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, format := range []SnapshotFormat{SnapshotGob, SnapshotJSON} {
+		c := newTestCache()
+		k := newTestKeep(c, func(k *Keep) { k.SetSnapshotFormat(format) })
+		if err := k.Prime("/a"); err != nil {
+			t.Fatal(err)
+		}
+		k.PathRequestedWithWeight("/a", 3)
+		k.Hit("/a")
+		want, _ := entryInfo(k, "/a")
+
+		snapshot := new(bytes.Buffer)
+		if err := k.WriteSnapshot(snapshot); err != nil {
+			t.Fatal(err)
+		}
+		k2 := newTestKeep(c, func(k *Keep) { k.SetSnapshotFormat(format) })
+		if err := k2.ReadSnapshot(snapshot); err != nil {
+			t.Fatal(err)
+		}
+		got, ok := entryInfo(k2, "/a")
+		if !ok {
+			t.Fatalf("format %d: entry not restored", format)
+		}
+		if got.Requests != want.Requests || got.Weight != want.Weight || got.Hits != want.Hits ||
+			got.Size != want.Size || !got.LastRequested.Equal(want.LastRequested) || got.Count != want.Count {
+			t.Errorf("format %d: restored %+v, want %+v", format, got, want)
+		}
+		if got.Size == 0 || got.Requests != 2 || got.Weight != 4 || got.Hits != 1 {
+			t.Errorf("format %d: unexpected counts %+v", format, got)
+		}
+	}
+}
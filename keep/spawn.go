@@ -0,0 +1,57 @@
+package keep
+
+import "sync"
+
+// spawner runs functions in goroutines, keeping count of them and
+// queueing them when there are too many.
+type spawner struct {
+	mutex   sync.Mutex
+	max     int
+	running int
+	pending []func()
+}
+
+// spawn runs f in a new goroutine, or queues it if the maximum number
+// of goroutines is running.
+func (s *spawner) spawn(f func()) {
+	s.mutex.Lock()
+	if s.max > 0 && s.running >= s.max {
+		s.pending = append(s.pending, f)
+		s.mutex.Unlock()
+		return
+	}
+	s.running++
+	s.mutex.Unlock()
+
+	go s.run(f)
+}
+
+func (s *spawner) run(f func()) {
+	for {
+		f()
+
+		s.mutex.Lock()
+		if len(s.pending) == 0 {
+			s.running--
+			s.mutex.Unlock()
+			return
+		}
+		f = s.pending[0]
+		s.pending = s.pending[1:]
+		s.mutex.Unlock()
+	}
+}
+
+func (s *spawner) counts() (running int, pending int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.running, len(s.pending)
+}
+
+// SetMaxGoroutines limits the number of goroutines the keep runs for
+// fetches and cache writes.  Work beyond the limit is queued until
+// other goroutines finish.  Zero, the default, means no limit.  It must
+// be called before Run.
+func (k *Keep) SetMaxGoroutines(n int) {
+	k.spawner.max = n
+}
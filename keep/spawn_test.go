@@ -0,0 +1,55 @@
+package keep
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSpawnerCap(t *testing.T) {
+	s := spawner{max: 2}
+	gate := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		s.spawn(func() {
+			defer wg.Done()
+			<-gate
+		})
+	}
+	if running, pending := s.counts(); running != 2 || pending != 3 {
+		t.Errorf("%d running and %d pending with a cap of 2", running, pending)
+	}
+
+	close(gate)
+	wg.Wait()
+	eventually(t, "the goroutines to finish", func() bool {
+		running, pending := s.counts()
+		return running == 0 && pending == 0
+	})
+}
+
+func TestGoroutinesDrain(t *testing.T) {
+	c := newTestCache()
+	k := newTestKeep(c, func(k *Keep) { k.SetMaxGoroutines(1) })
+
+	c.hold("/a")
+	results := startRequests(k, "/a", 3)
+	waitStarted(t, c, "/a")
+	for _, path := range []string{"/b", "/c"} {
+		if err := k.Prime(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.release("/a")
+	collect(t, results)
+
+	eventually(t, "the goroutines to drain", func() bool {
+		stats := k.Stats()
+		return stats.Goroutines == 0 && stats.QueuedGoroutines == 0
+	})
+	for _, path := range []string{"/a", "/b", "/c"} {
+		if _, ok := c.stored(path); !ok {
+			t.Errorf("%s not cached", path)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package keep
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+type splitCache struct {
+	reader Cache
+	writer Cache
+}
+
+// NewSplitCache returns a cache that reads from reader and writes to
+// writer, such as a replica and its primary.  Fetches from the
+// upstream go through writer, which must be a VariantCache for
+// encoded fetches.
+func NewSplitCache(reader Cache, writer Cache) Cache {
+	return splitCache{reader: reader, writer: writer}
+}
+
+func (c splitCache) Fetch(path string) (io.ReadCloser, error) {
+	return c.writer.Fetch(path)
+}
+
+func (c splitCache) Get(path string) ([]byte, error) {
+	return c.reader.Get(path)
+}
+
+func (c splitCache) Set(path string, data []byte) error {
+	return c.writer.Set(path, data)
+}
+
+func (c splitCache) SetContext(ctx context.Context, path string, data []byte) error {
+	cw, ok := c.writer.(ContextWriter)
+	if !ok {
+		return c.writer.Set(path, data)
+	}
+	return cw.SetContext(ctx, path, data)
+}
+
+func (c splitCache) Delete(path string) error {
+	return c.writer.Delete(path)
+}
+
+func (c splitCache) FetchEncoded(path string, encoding string) (io.ReadCloser, string, error) {
+	vc, ok := c.writer.(VariantCache)
+	if !ok {
+		return nil, "", errors.New("Cache does not support encoded variants")
+	}
+	return vc.FetchEncoded(path, encoding)
+}
+
+func (c splitCache) FetchContext(ctx context.Context, path string) (io.ReadCloser, error) {
+	cc, ok := c.writer.(ContextCache)
+	if !ok {
+		return c.writer.Fetch(path)
+	}
+	return cc.FetchContext(ctx, path)
+}
+
+func (c splitCache) Validator(path string) (string, error) {
+	vc, ok := c.writer.(ValidatingCache)
+	if !ok {
+		return "", errors.New("Cache does not support validators")
+	}
+	return vc.Validator(path)
+}
+
+func (c splitCache) ValidatorContext(ctx context.Context, path string) (string, error) {
+	vc, ok := c.writer.(ValidatingCache)
+	if !ok {
+		return "", errors.New("Cache does not support validators")
+	}
+	return fetchValidator(ctx, vc, path)
+}
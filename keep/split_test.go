@@ -0,0 +1,68 @@
+package keep
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestSplitCache(t *testing.T) {
+	reader := newTestCache()
+	writer := newTestCache()
+	c := NewSplitCache(reader, writer)
+
+	if err := c.Set("/a", []byte("written")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reader.stored("/a"); ok {
+		t.Error("wrote to the reader")
+	}
+	if data, _ := writer.stored("/a"); data != "written" {
+		t.Errorf("writer has %q", data)
+	}
+	if _, err := c.Get("/a"); err == nil {
+		t.Error("read from the writer")
+	}
+
+	reader.Set("/a", []byte("replicated"))
+	if data, err := c.Get("/a"); err != nil || string(data) != "replicated" {
+		t.Errorf("read %q, %v", data, err)
+	}
+
+	if err := c.Delete("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := writer.stored("/a"); ok {
+		t.Error("didn't delete from the writer")
+	}
+
+	body, err := c.Fetch("/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(data) != "data /b" || writer.fetchCount("/b") != 1 || reader.fetchCount("/b") != 0 {
+		t.Errorf("fetched %q, %d from the writer, %d from the reader", data, writer.fetchCount("/b"), reader.fetchCount("/b"))
+	}
+}
+
+func TestKeepWithSplitCache(t *testing.T) {
+	reader := newTestCache()
+	writer := newTestCache()
+	k := newTestKeep(NewSplitCache(reader, writer), nil)
+
+	if err := k.Prime("/a"); err != nil {
+		t.Fatal(err)
+	}
+	waitWritten(t, k, "/a")
+	if data, _ := writer.stored("/a"); data != "data /a" {
+		t.Errorf("writer has %q", data)
+	}
+
+	if _, ok := reader.stored("/a"); ok {
+		t.Error("wrote to the reader")
+	}
+	if writer.fetchCount("/a") != 1 {
+		t.Errorf("%d fetches through the writer", writer.fetchCount("/a"))
+	}
+}
@@ -0,0 +1,105 @@
+package keep
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stashedWhenFetched calls start, and returns whether the data of path
+// was stashed when the fetch finished, before the loop processes that.
+func stashedWhenFetched(k *Keep, path string, start func()) bool {
+	var stashed bool
+	inLoop(k, func(k *Keep) {
+		start()
+		for {
+			msg := <-k.messageChannel
+			if fetched, ok := msg.(*fetchedKeepMessage); ok && fetched.path == path {
+				_, stashed = k.stash.Load(path)
+				msg.process(k)
+				return
+			}
+			msg.process(k)
+		}
+	})
+	return stashed
+}
+
+func TestPushedFetchNotStashed(t *testing.T) {
+	c := newTestCache()
+	k := newTestKeep(c, nil)
+
+	c.hold("/a")
+	results := startRequests(k, "/a", 1)
+	waitStarted(t, c, "/a")
+	if !stashedWhenFetched(k, "/a", func() { c.release("/a") }) {
+		t.Error("the data of a finished fetch wasn't stashed")
+	}
+	collect(t, results)
+	eventually(t, "the fetch to finish", notFetching(k, "/a"))
+
+	// The push makes the running fetch's data stale.
+	c.hold("/a")
+	k.Refresh("/a")
+	waitStarted(t, c, "/a")
+	if err := k.Set("/a", []byte("pushed"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if stashedWhenFetched(k, "/a", func() { c.release("/a") }) {
+		t.Error("stashed the data of a fetch that started before a push")
+	}
+}
+
+// BenchmarkFinishedFetch measures bursts of requests for a path whose
+// fetch is finishing while the run loop is busy, with the stash and
+// without it, and reports how many of them had to wait for the loop to
+// hand them the data.
+func BenchmarkFinishedFetch(b *testing.B) {
+	const burst = 50
+	for _, mode := range []struct {
+		name    string
+		noStash bool
+	}{{"stash", false}, {"nostash", true}} {
+		b.Run(mode.name, func(b *testing.B) {
+			c := newTestCache()
+			var waiters int64
+			k := newTestKeep(c, func(k *Keep) {
+				k.noStash = mode.noStash
+				k.SetOnWaiter(func(path string, n int) { atomic.AddInt64(&waiters, 1) })
+			})
+			// Other work keeps the loop busy.
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				for {
+					select {
+					case <-done:
+						return
+					default:
+						inLoop(k, func(k *Keep) { time.Sleep(20 * time.Microsecond) })
+					}
+				}
+			}()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				path := fmt.Sprintf("/%d", i)
+				c.hold(path)
+				results := startRequests(k, path, 1)
+				<-c.started
+				c.release(path)
+				results = append(results, startRequests(k, path, burst)...)
+				for _, result := range results {
+					if result := <-result; result.err != nil {
+						b.Fatal(result.err)
+					}
+				}
+				for len(c.started) > 0 {
+					<-c.started
+				}
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&waiters))/float64(b.N), "waiters/op")
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package keep
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats are aggregate statistics about a keep.
+type Stats struct {
+	Entries     int
+	Fetching    int
+	Fetches     int
+	FetchErrors int
+	// RefreshInterval is the interval after which entries are
+	// refetched, as currently tuned.
+	RefreshInterval time.Duration
+	// Degraded is whether refreshes are paused because the
+	// upstream appears to be down.
+	Degraded bool
+	// Paused is whether refreshes are paused with Pause.
+	Paused bool
+	// Goroutines is the number of goroutines running fetches and
+	// cache writes, and QueuedGoroutines the number waiting to run.
+	Goroutines       int
+	QueuedGoroutines int
+	// Divergences is the number of verified cache hits that
+	// differed from the upstream past their expire time.
+	Divergences int
+	// Bytes is the size of the data of all entries.
+	Bytes          int64
+	Evictions      int
+	EvictionPolicy string
+	// SlowEntries is the number of entries whose fetches are slow.
+	SlowEntries int
+	// Upstreams is the number of fetches served by each upstream,
+	// if the cache reports them.
+	Upstreams map[string]int
+	// Lost is the number of times the data of an entry was found
+	// to be missing from the cache.
+	Lost int
+	// WriteTimeouts is the number of writes to the cache that
+	// timed out.
+	WriteTimeouts int64
+	// Hedges is the number of hedged requests sent, and HedgeWins
+	// the number of them that were faster.
+	Hedges    int64
+	HedgeWins int64
+	// SkippedRefreshes is the number of refreshes left to other
+	// instances by the refresh probability.
+	SkippedRefreshes int
+	// Hits is the number of requests served from the cache, and
+	// BytesSaved the size of the fetches they saved.
+	Hits       int
+	BytesSaved int64
+	// ResponseSizes is the distribution of the sizes of fetched
+	// bodies, in bytes.
+	ResponseSizes Histogram
+	// FetchDurations is the distribution of the durations of
+	// finished fetches, in seconds.
+	FetchDurations Histogram
+	// Labels are the fetch statistics by the label keys set with
+	// SetStatsLabels.
+	Labels []LabelStats
+}
+
+type statsKeepMessage struct {
+	reply chan<- Stats
+}
+
+func (k *Keep) sendStatsKeepMessage(reply chan<- Stats) {
+	msg := statsKeepMessage{reply: reply}
+	k.messageChannel <- &msg
+}
+
+func (msg *statsKeepMessage) process(k *Keep) {
+	stats := k.stats
+	if k.stats.Upstreams != nil {
+		stats.Upstreams = make(map[string]int)
+		for upstream, n := range k.stats.Upstreams {
+			stats.Upstreams[upstream] = n
+		}
+	}
+	stats.ResponseSizes = k.stats.ResponseSizes.copy()
+	stats.FetchDurations = k.stats.FetchDurations.copy()
+	for _, ls := range k.labelStats {
+		stats.Labels = append(stats.Labels, *ls)
+	}
+	stats.Entries = len(k.entries)
+	for _, e := range k.entries {
+		if e.info.Fetching {
+			stats.Fetching++
+		}
+		if e.info.Slow {
+			stats.SlowEntries++
+		}
+	}
+	stats.RefreshInterval = k.refreshInterval
+	stats.Degraded = k.breakerState != breakerClosed
+	stats.Paused = k.Paused()
+	stats.WriteTimeouts = atomic.LoadInt64(&k.writeTimeouts)
+	stats.Hedges = atomic.LoadInt64(&k.hedges)
+	stats.HedgeWins = atomic.LoadInt64(&k.hedgeWins)
+	stats.Goroutines, stats.QueuedGoroutines = k.spawner.counts()
+	stats.Bytes = k.totalBytes
+	stats.EvictionPolicy = k.evictionPolicy.Name()
+	msg.reply <- stats
+}
+
+// DefaultSizeBounds are the default bucket bounds of the response size
+// histogram.
+var DefaultSizeBounds = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20}
+
+// DurationBounds are the bucket bounds of the fetch duration
+// histogram, in seconds.
+var DurationBounds = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// SetSizeBounds sets the bucket bounds of the response size histogram,
+// in bytes and in increasing order.  The default is DefaultSizeBounds.
+// It must be called before Run.
+func (k *Keep) SetSizeBounds(bounds []float64) {
+	k.stats.ResponseSizes = newHistogram(bounds)
+}
+
+// Stats returns aggregate statistics about the keep.
+func (k *Keep) Stats() Stats {
+	c := make(chan Stats, 1)
+	k.sendStatsKeepMessage(c)
+	return <-c
+}
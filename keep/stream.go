@@ -0,0 +1,55 @@
+package keep
+
+import (
+	"io"
+)
+
+// A StreamCache can store data as it arrives, without it being
+// buffered first.  size is the number of bytes r will yield.
+type StreamCache interface {
+	SetStream(path string, r io.Reader, size int64) error
+}
+
+// SetStreamThreshold makes the keep stream bodies larger than threshold
+// bytes to the cache as they're fetched, if it's a StreamCache and no
+// transforms are set.  Only bodies whose size the upstream reports are
+// streamed, and not when several paths share an upstream path.  Zero,
+// the default, disables streaming.  It must be called before Run.
+func (k *Keep) SetStreamThreshold(threshold int64) {
+	k.streamThreshold = threshold
+}
+
+func (k *Keep) shouldStream(paths []string, size int64) (StreamCache, bool) {
+	sc, ok := k.cache.(StreamCache)
+	if !ok || k.streamThreshold <= 0 || size <= k.streamThreshold {
+		return nil, false
+	}
+	return sc, len(paths) == 1 && len(k.transforms) == 0
+}
+
+// streamToCache copies reader to both the cache under path and the
+// writer writerMaker makes.  It returns the ETag of the data, and the
+// error of the cache separately from the error of the copy.
+func (k *Keep) streamToCache(sc StreamCache, path string, reader io.Reader, size int64, writerMaker WriterMaker) (etag string, setErr error, err error) {
+	hash := k.etagHash()
+	pr, pw := io.Pipe()
+	setDone := make(chan error, 1)
+	go func() {
+		err := sc.SetStream(path, pr, size)
+		// If the cache gave up, the copy must not block.
+		pr.CloseWithError(err)
+		setDone <- err
+	}()
+
+	n, err := io.Copy(writerMaker(io.MultiWriter(pw, hash)), reader)
+	if err == nil {
+		err = k.checkLength(n, size)
+	}
+	// The cache must not keep truncated data.
+	pw.CloseWithError(err)
+	setErr = <-setDone
+	if err != nil || setErr != nil {
+		return "", setErr, err
+	}
+	return k.formatETag(hash.Sum(nil)), nil, nil
+}
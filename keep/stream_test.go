@@ -0,0 +1,109 @@
+package keep
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// streamCache is a testCache that's a StreamCache, counting the paths
+// streamed to it.
+type streamCache struct {
+	*testCache
+	streamed map[string]int64
+}
+
+func newStreamCache() *streamCache {
+	return &streamCache{testCache: newTestCache(), streamed: make(map[string]int64)}
+}
+
+func (c *streamCache) SetStream(path string, r io.Reader, size int64) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.streamed[path] = size
+	c.data[path] = data
+	return nil
+}
+
+func (c *streamCache) streamedSize(path string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	size, ok := c.streamed[path]
+	return size, ok
+}
+
+// setSized sets the body of path, with a Content-Length of length.
+func (c *streamCache) setSized(path string, body string, length int) {
+	c.setBody(path, body)
+	c.setHeader(path, http.Header{"Content-Length": {strconv.Itoa(length)}})
+}
+
+func TestStreamLargeBodies(t *testing.T) {
+	c := newStreamCache()
+	large := strings.Repeat("x", 100)
+	c.setSized("/large", large, len(large))
+	c.setSized("/small", "small", len("small"))
+	// Without a Content-Length the size isn't known.
+	c.setBody("/unsized", large)
+	k := newTestKeep(c, func(k *Keep) { k.SetStreamThreshold(50) })
+
+	if result := request(k, "/large"); result.err != nil || result.data != large {
+		t.Fatalf("got %+v", result)
+	}
+	waitWritten(t, k, "/large")
+	if size, ok := c.streamedSize("/large"); !ok || size != int64(len(large)) {
+		t.Errorf("streamed %d bytes, %v", size, ok)
+	}
+	if data, _ := c.stored("/large"); data != large || c.setCount("/large") != 0 {
+		t.Errorf("stored %d bytes, %d sets", len(data), c.setCount("/large"))
+	}
+	if ei, _ := entryInfo(k, "/large"); ei.Size != len(large) {
+		t.Errorf("entry has size %d", ei.Size)
+	}
+	if k.ETag("/large") == "" {
+		t.Error("no ETag for streamed data")
+	}
+
+	for _, path := range []string{"/small", "/unsized"} {
+		if result := request(k, path); result.err != nil {
+			t.Fatal(result.err)
+		}
+		waitWritten(t, k, path)
+		if _, ok := c.streamedSize(path); ok || c.setCount(path) != 1 {
+			t.Errorf("%s: streamed instead of set", path)
+		}
+	}
+}
+
+func TestStreamedWaiters(t *testing.T) {
+	c := newStreamCache()
+	large := strings.Repeat("x", 100)
+	c.setSized("/large", large, len(large))
+	hook := newWaiterHook()
+	k := newTestKeep(c, func(k *Keep) {
+		k.SetStreamThreshold(50)
+		k.SetOnWaiter(hook.onWaiter)
+	})
+
+	c.hold("/large")
+	results := startRequests(k, "/large", 3)
+	waitStarted(t, c.testCache, "/large")
+	hook.wait(t, 2)
+	c.release("/large")
+	// The waiters get the streamed data from the cache.
+	for _, result := range collect(t, results) {
+		if result.err != nil || result.data != large {
+			t.Errorf("got %d bytes, %v", len(result.data), result.err)
+		}
+	}
+	if n := c.fetchCount("/large"); n != 1 {
+		t.Errorf("%d fetches", n)
+	}
+}
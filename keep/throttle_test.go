@@ -0,0 +1,60 @@
+package keep
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// nextStarted returns the path of the next fetch to start.
+func nextStarted(t *testing.T, c *testCache) string {
+	t.Helper()
+	select {
+	case path := <-c.started:
+		return path
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a fetch")
+		return ""
+	}
+}
+
+func TestThrottledRefreshesNotStarved(t *testing.T) {
+	const n = 5
+	c := newTestCache()
+	k := NewKeep(c, 500*time.Millisecond, 1000, 0)
+	k.SetMaxFetches(1)
+	go k.Run()
+
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("/%d", i)
+		if err := k.Prime(paths[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range paths {
+		c.hold(path)
+		nextStarted(t, c)
+	}
+
+	// The refreshes are slow, so one runs at a time, and each entry
+	// gets one before any gets a second.
+	for round := 0; round < 2; round++ {
+		refreshed := make(map[string]bool)
+		for i := 0; i < n; i++ {
+			path := nextStarted(t, c)
+			if refreshed[path] {
+				t.Fatalf("round %d: %s refreshed again before %v", round, path, refreshed)
+			}
+			refreshed[path] = true
+			if round == 0 {
+				select {
+				case other := <-c.started:
+					t.Fatalf("refreshing %s while %s is", other, path)
+				case <-time.After(20 * time.Millisecond):
+				}
+				c.release(path)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package keep
+
+import (
+	"time"
+)
+
+// SetPerEntryTimers makes every entry have its own timer for when it's
+// due to be refetched, instead of the keep keeping a schedule of all
+// entries with one timer.  That's simpler when there are only a handful
+// of entries, with very different expire times, but every entry costs
+// a timer, so the schedule is better for large keeps.  It must be
+// called before Run.
+func (k *Keep) SetPerEntryTimers(perEntry bool) {
+	k.perEntryTimers = perEntry
+}
+
+type dueKeepMessage struct {
+	item scheduleItem
+}
+
+func (k *Keep) sendDueKeepMessage(item scheduleItem) {
+	msg := dueKeepMessage{item: item}
+	k.messageChannel <- &msg
+}
+
+// A due entry is queued until it's fetched.  If its timer was stopped
+// or reset in the meantime, or the entry is gone, the item is invalid
+// and dropped by nextDue.
+func (msg *dueKeepMessage) process(k *Keep) {
+	e := msg.item.e
+	if k.entries[e.info.Path] != e || !msg.item.due.Equal(e.due) {
+		return
+	}
+	e.timer = nil
+	k.due = append(k.due, msg.item)
+}
+
+// startEntryTimer sets the timer of e for when it's due.
+func (k *Keep) startEntryTimer(e *entry) {
+	k.stopEntryTimer(e)
+	item := scheduleItem{e: e, due: e.due}
+	e.timer = time.AfterFunc(e.due.Sub(time.Now()), func() { k.sendDueKeepMessage(item) })
+}
+
+func (k *Keep) stopEntryTimer(e *entry) {
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+}
+
+// nextDueEntry is nextDue for per-entry timers, where only due entries
+// are queued.
+func (k *Keep) nextDueEntry() (*entry, bool) {
+	for len(k.due) > 0 {
+		item := k.due[0]
+		if !item.valid() {
+			k.due = k.due[1:]
+			if item.due.Equal(item.e.due) {
+				item.e.due = time.Time{}
+			}
+			continue
+		}
+		due := k.expireTime(item.e.info)
+		if due.After(item.due) {
+			k.due = k.due[1:]
+			item.e.due = time.Time{}
+			k.reschedule(item.e)
+			continue
+		}
+		return item.e, true
+	}
+	return nil, false
+}
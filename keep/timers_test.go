@@ -0,0 +1,89 @@
+package keep
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// inspectKeepMessage runs f in the run loop, so that tests can look at
+// the keep's state.
+type inspectKeepMessage struct {
+	f    func(k *Keep)
+	done chan struct{}
+}
+
+func (msg *inspectKeepMessage) process(k *Keep) {
+	msg.f(k)
+	close(msg.done)
+}
+
+func inLoop(k *Keep, f func(k *Keep)) {
+	msg := inspectKeepMessage{f: f, done: make(chan struct{})}
+	k.messageChannel <- &msg
+	<-msg.done
+}
+
+// hasTimer returns whether the entry for path has a running timer.
+func hasTimer(k *Keep, path string) bool {
+	var running bool
+	inLoop(k, func(k *Keep) {
+		e, ok := k.entries[path]
+		running = ok && e.timer != nil
+	})
+	return running
+}
+
+func TestPerEntryTimersRefresh(t *testing.T) {
+	c := newTestCache()
+	k := NewKeep(c, 50*time.Millisecond, 5, 0)
+	k.SetPerEntryTimers(true)
+	go k.Run()
+
+	if err := k.Prime("/a"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "a timer", func() bool { return hasTimer(k, "/a") })
+	eventually(t, "a refresh", func() bool { return c.fetchCount("/a") >= 2 })
+	inLoop(k, func(k *Keep) {
+		if k.timer != nil || len(k.schedule) != 0 {
+			t.Error("the keep's timer or schedule is used")
+		}
+	})
+}
+
+func TestPerEntryTimerStopped(t *testing.T) {
+	c := newTestCache()
+	c.setBody("/a", strings.Repeat("x", 50))
+	c.setBody("/b", strings.Repeat("x", 50))
+	k := newTestKeep(c, func(k *Keep) {
+		k.SetPerEntryTimers(true)
+		k.SetMaxBytes(70, EvictLRU)
+	})
+
+	for _, path := range []string{"/a", "/b"} {
+		if result := request(k, path); result.err != nil {
+			t.Fatal(result.err)
+		}
+		waitWritten(t, k, path)
+	}
+	eventually(t, "an eviction", func() bool { return k.Stats().Evictions == 1 })
+	if hasTimer(k, "/a") {
+		t.Error("the evicted entry's timer is running")
+	}
+	if !hasTimer(k, "/b") {
+		t.Error("the kept entry has no timer")
+	}
+
+	k.Register("/c")
+	waitWritten(t, k, "/c")
+	eventually(t, "a timer", func() bool { return hasTimer(k, "/c") })
+	var e *entry
+	inLoop(k, func(k *Keep) { e = k.entries["/c"] })
+	k.Unregister("/c")
+	inLoop(k, func(k *Keep) {
+		if e.timer != nil {
+			t.Error("the unregistered entry's timer is running")
+		}
+	})
+}
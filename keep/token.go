@@ -0,0 +1,98 @@
+package keep
+
+import (
+	"time"
+)
+
+// A Token stands for a fetch of a path, and is used to wait for data
+// that was fetched at or after some point.
+type Token uint64
+
+type tokenWaiter struct {
+	token Token
+	reply chan<- tokenResult
+}
+
+type tokenResult struct {
+	data []byte
+	ok   bool
+}
+
+type waitForTokenKeepMessage struct {
+	path   string
+	waiter tokenWaiter
+	// If since is given, the waiter waits for the next fetch,
+	// unless one succeeded after since.
+	since time.Time
+}
+
+func (k *Keep) sendWaitForTokenKeepMessage(path string, waiter tokenWaiter, since time.Time) {
+	msg := waitForTokenKeepMessage{path: path, waiter: waiter, since: since}
+	k.messageChannel <- &msg
+}
+
+func (msg *waitForTokenKeepMessage) process(k *Keep) {
+	e, ok := k.entries[msg.path]
+	if ok && !msg.since.IsZero() {
+		if e.info.LastErr == nil && e.info.LastFetched.After(msg.since) {
+			msg.waiter.token = Token(e.fetches)
+		} else {
+			msg.waiter.token = Token(e.fetches + 1)
+		}
+	}
+	if !ok || msg.waiter.token == 0 {
+		msg.waiter.reply <- tokenResult{}
+		return
+	}
+	if Token(e.fetches) >= msg.waiter.token && e.writes == 0 {
+		msg.waiter.reply <- tokenResult{ok: true}
+		return
+	}
+	e.tokenWaiters = append(e.tokenWaiters, msg.waiter)
+}
+
+// notifyTokenWaiters hands the data of result to the token waiters of e
+// whose fetch it is.  Waiters that gave up are notified, too, because
+// their replies are buffered.
+func (k *Keep) notifyTokenWaiters(e *entry, result fetchResult) {
+	if result.Err != nil || len(e.tokenWaiters) == 0 {
+		return
+	}
+	waiters := e.tokenWaiters[:0]
+	for _, waiter := range e.tokenWaiters {
+		if Token(e.fetches) >= waiter.token {
+			waiter.reply <- tokenResult{data: result.Data, ok: true}
+		} else {
+			waiters = append(waiters, waiter)
+		}
+	}
+	e.tokenWaiters = waiters
+}
+
+// WaitForToken waits until path is fetched at or after the Refresh
+// that returned token, so that a client that changed the data upstream
+// reads its own write.  It returns the fetched data, which is nil if it
+// must be read from the cache, and false if it waited for longer than
+// timeout.  A failed fetch doesn't count, so the wait continues until
+// the next one, or the timeout.
+func (k *Keep) WaitForToken(path string, token Token, timeout time.Duration) ([]byte, bool) {
+	return k.waitForToken(path, token, time.Time{}, timeout)
+}
+
+// WaitForFetch waits until a fetch of path that finished after since
+// succeeds, which it might already have, like WaitForToken.  It
+// doesn't make the keep fetch the path.
+func (k *Keep) WaitForFetch(path string, since time.Time, timeout time.Duration) ([]byte, bool) {
+	return k.waitForToken(path, 0, since, timeout)
+}
+
+func (k *Keep) waitForToken(path string, token Token, since time.Time, timeout time.Duration) ([]byte, bool) {
+	c := make(chan tokenResult, 1)
+	k.sendWaitForTokenKeepMessage(path, tokenWaiter{token: token, reply: c}, since)
+	select {
+	case result := <-c:
+		return result.data, result.ok
+	case <-time.After(timeout):
+		return nil, false
+	}
+}
@@ -0,0 +1,142 @@
+package keep
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// readToken waits for token, and returns the data it was fetched with,
+// reading it from the cache if it must.
+func readToken(t *testing.T, k *Keep, c *testCache, path string, token Token) string {
+	t.Helper()
+	data, ok := k.WaitForToken(path, token, 5*time.Second)
+	if !ok {
+		t.Fatalf("timed out waiting for token %d", token)
+	}
+	if data == nil {
+		stored, _ := c.stored(path)
+		return stored
+	}
+	return string(data)
+}
+
+func TestRefreshTokenReadsOwnWrite(t *testing.T) {
+	c := newTestCache()
+	k := newTestKeep(c, nil)
+
+	c.setBody("/a", "v1")
+	if result := request(k, "/a"); result.err != nil {
+		t.Fatal(result.err)
+	}
+	eventually(t, "the fetch to finish", notFetching(k, "/a"))
+
+	// Each refresh gets a token for the fetch right after it, which
+	// sees the write made before it.
+	for _, body := range []string{"v2", "v3"} {
+		c.setBody("/a", body)
+		token := k.Refresh("/a")
+		if token == 0 {
+			t.Fatal("no token for a kept path")
+		}
+		if data := readToken(t, k, c, "/a", token); data != body {
+			t.Errorf("token %d read %q, want %q", token, data, body)
+		}
+		eventually(t, "the fetch to finish", notFetching(k, "/a"))
+	}
+	if n := c.fetchCount("/a"); n != 3 {
+		t.Errorf("%d upstream fetches, want 3", n)
+	}
+}
+
+func TestRefreshTokenWhileFetching(t *testing.T) {
+	c := newTestCache()
+	k := newTestKeep(c, nil)
+
+	c.setBody("/a", "v1")
+	if result := request(k, "/a"); result.err != nil {
+		t.Fatal(result.err)
+	}
+	eventually(t, "the fetch to finish", notFetching(k, "/a"))
+
+	// Skip the start of the request's fetch.
+	waitStarted(t, c, "/a")
+
+	c.hold("/a")
+	k.Refresh("/a")
+	waitStarted(t, c, "/a")
+
+	// The running fetch might have read the data before this write,
+	// so the token is for the one after it.
+	c.setBody("/a", "v2")
+	token := k.Refresh("/a")
+	c.release("/a")
+	if data := readToken(t, k, c, "/a", token); data != "v2" {
+		t.Errorf("token %d read %q, want v2", token, data)
+	}
+	if n := c.fetchCount("/a"); n != 3 {
+		t.Errorf("%d upstream fetches, want 3", n)
+	}
+}
+
+func TestRefreshStaleWhileFetching(t *testing.T) {
+	c := newTestCache()
+	k := newTestKeep(c, nil)
+	if err := k.Prime("/a"); err != nil {
+		t.Fatal(err)
+	}
+	waitStarted(t, c, "/a")
+	eventually(t, "the fetch to finish", notFetching(k, "/a"))
+
+	c.hold("/a")
+	k.RefreshStale("/a")
+	waitStarted(t, c, "/a")
+	// The running fetch is the refresh, so these don't take another.
+	k.RefreshStale("/a")
+	k.RefreshStale("/a")
+	c.setErr("/a", errors.New("upstream down"))
+	c.release("/a")
+	eventually(t, "the fetch to finish", notFetching(k, "/a"))
+
+	if n := c.fetchCount("/a"); n != 2 {
+		t.Errorf("%d upstream fetches, want 2", n)
+	}
+	if ei, _ := entryInfo(k, "/a"); ei.LastFetched.IsZero() || ei.LastErrTime.IsZero() {
+		t.Errorf("the failed refresh left %+v", ei)
+	}
+}
+
+func TestRefreshPendingKeepsErrTime(t *testing.T) {
+	c := newTestCache()
+	k := newTestKeep(c, nil)
+	if err := k.Prime("/a"); err != nil {
+		t.Fatal(err)
+	}
+	waitStarted(t, c, "/a")
+	eventually(t, "the fetch to finish", notFetching(k, "/a"))
+
+	c.hold("/a")
+	c.setErr("/a", errors.New("upstream down"))
+	k.Refresh("/a")
+	waitStarted(t, c, "/a")
+	// Paused, the pending refetch isn't started, so we can see the
+	// failed one.
+	k.Pause()
+	k.Refresh("/a")
+	c.release("/a")
+	eventually(t, "the fetch to finish", notFetching(k, "/a"))
+
+	if ei, _ := entryInfo(k, "/a"); !ei.LastFetched.IsZero() || ei.LastErrTime.IsZero() {
+		t.Errorf("the pending refresh left %+v", ei)
+	}
+}
+
+func TestTokenForUnknownPath(t *testing.T) {
+	k := newTestKeep(newTestCache(), nil)
+	if token := k.Refresh("/nope"); token != 0 {
+		t.Errorf("got token %d for a path that isn't kept", token)
+	}
+	if _, ok := k.WaitForToken("/nope", 1, time.Second); ok {
+		t.Error("waiting for a path that isn't kept succeeded")
+	}
+}
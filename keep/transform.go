@@ -0,0 +1,69 @@
+package keep
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// A Transform rewrites the body fetched for path.  The returned body is
+// what gets served and cached.  If it returns an error the fetch
+// fails and nothing is cached.
+type Transform func(path string, body []byte) ([]byte, error)
+
+// AddTransform adds t to the transforms applied to every fetched body.
+// Transforms are applied in the order they were added.  It must be
+// called before Run.
+func (k *Keep) AddTransform(t Transform) {
+	k.transforms = append(k.transforms, t)
+}
+
+func (k *Keep) applyTransforms(path string, body []byte) ([]byte, error) {
+	for _, t := range k.transforms {
+		var err error
+		body, err = t(path, body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// A URLRewrite replaces URLs starting with From by ones starting with
+// To instead.
+type URLRewrite struct {
+	From string
+	To   string
+}
+
+// jsonString returns s as it appears in a JSON string, without the
+// quotes.
+func jsonString(s string) string {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(s)
+	quoted := strings.TrimSpace(buffer.String())
+	return quoted[1 : len(quoted)-1]
+}
+
+// URLRewriteTransform returns a transform that applies rewrites to the
+// URLs in a JSON body, such as links to the upstream that should point
+// to the cache.  URLs with escaped slashes are rewritten, too.  Where
+// rewrites overlap, the earlier one wins.
+func URLRewriteTransform(rewrites []URLRewrite) Transform {
+	var pairs []string
+	for _, rewrite := range rewrites {
+		from := jsonString(rewrite.From)
+		to := jsonString(rewrite.To)
+		pairs = append(pairs, from, to)
+		escapedFrom := strings.Replace(from, "/", `\/`, -1)
+		if escapedFrom != from {
+			pairs = append(pairs, escapedFrom, strings.Replace(to, "/", `\/`, -1))
+		}
+	}
+	replacer := strings.NewReplacer(pairs...)
+	return func(path string, body []byte) ([]byte, error) {
+		return []byte(replacer.Replace(string(body))), nil
+	}
+}
@@ -0,0 +1,63 @@
+package keep
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SetHonorCacheControl makes the keep take a soft and a hard TTL for an
+// entry from the max-age and stale-while-revalidate directives in the
+// Cache-Control header of its response, if the cache returns response
+// headers.  The entry is refetched after the soft TTL instead of the
+// refresh interval, and its data is not served past the hard TTL, its
+// MaxServedAge.  Without stale-while-revalidate, the hard TTL is the
+// soft one.  Responses without a positive max-age keep the entry's
+// TTLs as they were.  It must be called before Run.
+func (k *Keep) SetHonorCacheControl(honor bool) {
+	k.honorCacheControl = honor
+}
+
+// minSoftTTL is the shortest soft TTL taken from a response, so that an
+// upstream can't make the keep refetch continuously.
+const minSoftTTL = time.Second
+
+// parseTTLs returns the soft and hard TTLs given by the Cache-Control
+// header, or zero if there's no max-age.
+func parseTTLs(header http.Header) (soft time.Duration, hard time.Duration) {
+	var maxAge, staleWhileRevalidate int64
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		seconds, err := strconv.ParseInt(strings.Trim(parts[1], `"`), 10, 64)
+		if err != nil || seconds < 0 {
+			continue
+		}
+		switch strings.ToLower(parts[0]) {
+		case "max-age":
+			maxAge = seconds
+		case "stale-while-revalidate":
+			staleWhileRevalidate = seconds
+		}
+	}
+	if maxAge <= 0 {
+		return 0, 0
+	}
+	soft = time.Duration(maxAge) * time.Second
+	if soft < minSoftTTL {
+		soft = minSoftTTL
+	}
+	return soft, soft + time.Duration(staleWhileRevalidate)*time.Second
+}
+
+// updateTTLs sets the TTLs of e from the response of a fetch.
+func (k *Keep) updateTTLs(e *entry, result fetchResult) {
+	if result.softTTL <= 0 {
+		return
+	}
+	e.info.SoftTTL = result.softTTL
+	e.info.MaxServedAge = result.hardTTL
+}
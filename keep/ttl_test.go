@@ -0,0 +1,107 @@
+package keep
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseTTLs(t *testing.T) {
+	for _, test := range []struct {
+		cacheControl string
+		soft, hard   time.Duration
+	}{
+		{"", 0, 0},
+		{"no-cache", 0, 0},
+		{"max-age=0", 0, 0},
+		{"max-age=60", time.Minute, time.Minute},
+		{"public, max-age=60, stale-while-revalidate=30", time.Minute, 90 * time.Second},
+		{`Max-Age="60"`, time.Minute, time.Minute},
+		{"stale-while-revalidate=30", 0, 0},
+		{"max-age=-5", 0, 0},
+	} {
+		header := make(http.Header)
+		header.Set("Cache-Control", test.cacheControl)
+		soft, hard := parseTTLs(header)
+		if soft != test.soft || hard != test.hard {
+			t.Errorf("%q: got %v, %v, want %v, %v", test.cacheControl, soft, hard, test.soft, test.hard)
+		}
+	}
+}
+
+func TestCacheControlTTLs(t *testing.T) {
+	c := newTestCache()
+	c.setHeader("/a", http.Header{"Cache-Control": {"max-age=60, stale-while-revalidate=30"}})
+	c.setHeader("/b", http.Header{"Cache-Control": {"max-age=60"}})
+	k := newTestKeep(c, func(k *Keep) { k.SetHonorCacheControl(true) })
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		if result := request(k, path); result.err != nil {
+			t.Fatalf("%s: %v", path, result.err)
+		}
+		eventually(t, "the fetch to finish", notFetching(k, path))
+	}
+
+	for _, test := range []struct {
+		path              string
+		soft, maxServeAge time.Duration
+	}{
+		{"/a", time.Minute, 90 * time.Second},
+		{"/b", time.Minute, time.Minute},
+		{"/c", 0, 0},
+	} {
+		ei, _ := entryInfo(k, test.path)
+		if ei.SoftTTL != test.soft || ei.MaxServedAge != test.maxServeAge {
+			t.Errorf("%s: got TTLs %v, %v, want %v, %v", test.path, ei.SoftTTL, ei.MaxServedAge, test.soft, test.maxServeAge)
+		}
+	}
+
+	expiredBy, overMaxAge := k.Staleness("/a")
+	if expiredBy > -59*time.Second || expiredBy < -time.Minute || overMaxAge {
+		t.Errorf("fresh entry expired by %v, over its maximum age: %v", expiredBy, overMaxAge)
+	}
+}
+
+func TestCacheControlIgnored(t *testing.T) {
+	c := newTestCache()
+	c.setHeader("/a", http.Header{"Cache-Control": {"max-age=60"}})
+	k := newTestKeep(c, nil)
+
+	if result := request(k, "/a"); result.err != nil {
+		t.Fatal(result.err)
+	}
+	eventually(t, "the fetch to finish", notFetching(k, "/a"))
+	if ei, _ := entryInfo(k, "/a"); ei.SoftTTL != 0 || ei.MaxServedAge != 0 {
+		t.Errorf("got TTLs %v, %v without honoring Cache-Control", ei.SoftTTL, ei.MaxServedAge)
+	}
+}
+
+func TestCacheControlWindows(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the TTLs to pass")
+	}
+
+	c := newTestCache()
+	c.setHeader("/a", http.Header{"Cache-Control": {"max-age=1, stale-while-revalidate=1"}})
+	k := newTestKeep(c, func(k *Keep) { k.SetHonorCacheControl(true) })
+
+	if result := request(k, "/a"); result.err != nil {
+		t.Fatal(result.err)
+	}
+	eventually(t, "the fetch to finish", notFetching(k, "/a"))
+	// Keep the refetch from finishing, so the data ages.
+	c.hold("/a")
+	defer c.release("/a")
+
+	time.Sleep(1200 * time.Millisecond)
+	expiredBy, overMaxAge := k.Staleness("/a")
+	if expiredBy <= 0 || overMaxAge {
+		t.Errorf("in the soft window, expired by %v, over its maximum age: %v", expiredBy, overMaxAge)
+	}
+
+	time.Sleep(time.Second)
+	expiredBy, overMaxAge = k.Staleness("/a")
+	if expiredBy <= time.Second || !overMaxAge {
+		t.Errorf("past the hard TTL, expired by %v, over its maximum age: %v", expiredBy, overMaxAge)
+	}
+}
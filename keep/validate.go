@@ -0,0 +1,95 @@
+package keep
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// A ValidatingCache is a cache that can cheaply fetch the validator,
+// such as the ETag, of a path from the upstream, e.g. with a HEAD
+// request.
+type ValidatingCache interface {
+	Cache
+	Validator(path string) (string, error)
+}
+
+// A ContextValidatingCache can abandon fetching a validator when ctx is
+// cancelled.
+type ContextValidatingCache interface {
+	ValidatorContext(ctx context.Context, path string) (string, error)
+}
+
+// A ValidatedBody is a fetched body that knows its validator.  Fetch
+// can return one to make refreshes validate first.
+type ValidatedBody interface {
+	io.ReadCloser
+	Validator() string
+}
+
+// SetValidateRefreshes makes refreshes first fetch the validator of
+// the path, and only fetch the data if the validator has changed.  The
+// cache must be a ValidatingCache, and Fetch must return a
+// ValidatedBody.  It must be called before Run.
+func (k *Keep) SetValidateRefreshes(validate bool) {
+	k.validateRefreshes = validate
+}
+
+// refresh fetches path in the background.  If validator is given and
+// matches the upstream's, the data is not fetched again.  etag is the
+// ETag of the data in the cache.
+func (k *Keep) refresh(ctx context.Context, path string, validator string, etag string) (FetchInfo, error) {
+	vc, ok := k.cache.(ValidatingCache)
+	if validator != "" && ok {
+		startTime := time.Now()
+		current, err := fetchValidator(ctx, vc, k.upstreamPath(path))
+		duration := time.Now().Sub(startTime)
+		if err == nil && current == validator {
+			// Only if we still have the data, otherwise the
+			// waiters would get nothing.
+			data, err := k.cache.Get(path)
+			if err == nil {
+				fmt.Printf("unchanged %s\n", path)
+				k.sendFetchedMessage(path, fetchResult{Data: data, duration: duration, validator: validator, etag: k.computeETag(data)})
+				info := FetchInfo{Path: path, Data: data, FromCache: true, Duration: duration}
+				k.fetched(info)
+				return info, nil
+			}
+		}
+	}
+
+	return k.fetchAliases(ctx, []string{path}, etag, func(w io.Writer) io.Writer { return w })
+}
+
+func fetchValidator(ctx context.Context, vc ValidatingCache, path string) (string, error) {
+	cvc, ok := vc.(ContextValidatingCache)
+	if !ok {
+		return vc.Validator(path)
+	}
+	return cvc.ValidatorContext(ctx, path)
+}
+
+type revalidatingKeepMessage struct {
+	path  string
+	reply chan<- bool
+}
+
+func (k *Keep) sendRevalidatingKeepMessage(path string, reply chan<- bool) {
+	msg := revalidatingKeepMessage{path: path, reply: reply}
+	k.messageChannel <- &msg
+}
+
+func (msg *revalidatingKeepMessage) process(k *Keep) {
+	e, ok := k.entries[msg.path]
+	msg.reply <- ok && e.revalidating
+}
+
+// Revalidating returns whether path is being refreshed by checking its
+// validator.  The upstream likely reports the data unchanged, so it
+// can still be served while waiting for that.
+func (k *Keep) Revalidating(path string) bool {
+	c := make(chan bool, 1)
+	k.sendRevalidatingKeepMessage(path, c)
+	return <-c
+}
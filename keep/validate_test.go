@@ -0,0 +1,115 @@
+package keep
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+)
+
+// validatingCache is a testCache whose upstream has validators, which
+// it reports with ValidatorContext.
+type validatingCache struct {
+	*testCache
+	mu         sync.Mutex
+	validators map[string]string
+	heads      int
+	contexts   int
+}
+
+func newValidatingCache() *validatingCache {
+	return &validatingCache{testCache: newTestCache(), validators: make(map[string]string)}
+}
+
+type validatedTestBody struct {
+	testBody
+	validator string
+}
+
+func (b validatedTestBody) Validator() string {
+	return b.validator
+}
+
+func (c *validatingCache) setValidator(path string, validator string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.validators[path] = validator
+}
+
+func (c *validatingCache) Fetch(path string) (io.ReadCloser, error) {
+	body, err := c.testCache.Fetch(path)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return validatedTestBody{testBody: body.(testBody), validator: c.validators[path]}, nil
+}
+
+func (c *validatingCache) Validator(path string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.heads++
+	return c.validators[path], nil
+}
+
+func (c *validatingCache) ValidatorContext(ctx context.Context, path string) (string, error) {
+	c.mu.Lock()
+	c.contexts++
+	c.mu.Unlock()
+	return c.Validator(path)
+}
+
+func TestValidatedRefresh(t *testing.T) {
+	c := newValidatingCache()
+	c.setValidator("/a", "v1")
+	k := newTestKeep(c, func(k *Keep) { k.SetValidateRefreshes(true) })
+
+	if result := request(k, "/a"); result.err != nil {
+		t.Fatal(result.err)
+	}
+	eventually(t, "the fetch to finish", notFetching(k, "/a"))
+	waitWritten(t, k, "/a")
+
+	// The validator is unchanged, so the data isn't fetched again.
+	token := k.Refresh("/a")
+	if data := readToken(t, k, c.testCache, "/a", token); data != "data /a" {
+		t.Errorf("unchanged refresh read %q", data)
+	}
+	if n := c.fetchCount("/a"); n != 1 {
+		t.Errorf("%d fetches for an unchanged validator", n)
+	}
+
+	c.setValidator("/a", "v2")
+	c.setBody("/a", "changed")
+	eventually(t, "the refresh to finish", notFetching(k, "/a"))
+	token = k.Refresh("/a")
+	if data := readToken(t, k, c.testCache, "/a", token); data != "changed" {
+		t.Errorf("changed refresh read %q", data)
+	}
+	if n := c.fetchCount("/a"); n != 2 {
+		t.Errorf("%d fetches, want 2", n)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.heads != 2 || c.contexts != 2 {
+		t.Errorf("%d validator fetches, %d with a context, want 2 with one", c.heads, c.contexts)
+	}
+}
+
+func TestNamespacedValidator(t *testing.T) {
+	c := newValidatingCache()
+	c.setValidator("/a", "v1")
+	nc := NewNamespacedCache(c, "ns:").(ValidatingCache)
+	validator, err := fetchValidator(context.Background(), nc, "/a")
+	if err != nil || validator != "v1" {
+		t.Errorf("got %s, %v", validator, err)
+	}
+	if c.contexts != 1 {
+		t.Error("the namespaced cache didn't pass the context on")
+	}
+	if _, err := fetchValidator(context.Background(), NewNamespacedCache(NopCache{}, "ns:").(ValidatingCache), "/a"); err == nil {
+		t.Error("got a validator from a cache without any")
+	}
+}
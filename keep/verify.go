@@ -0,0 +1,73 @@
+package keep
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"time"
+)
+
+type divergedKeepMessage struct {
+	path string
+}
+
+func (k *Keep) sendDivergedKeepMessage(path string) {
+	msg := divergedKeepMessage{path: path}
+	k.messageChannel <- &msg
+}
+
+func (msg *divergedKeepMessage) process(k *Keep) {
+	e, ok := k.entries[msg.path]
+	if !ok {
+		return
+	}
+
+	// The upstream changing between refreshes is expected.  It's
+	// only a problem if we should have refetched it by now.
+	if time.Now().After(k.expireTime(e.info)) {
+		fmt.Printf("cached data for %s is stale beyond its expire time\n", msg.path)
+		k.stats.Divergences++
+	}
+}
+
+// SetVerifyRate makes the keep fetch a fresh copy for the given
+// fraction of cache hits reported with MaybeVerify, to check whether
+// the cache serves data it should have refreshed.  The default is
+// zero.  It must be called before Run.
+func (k *Keep) SetVerifyRate(rate float64) {
+	k.verifyRate = rate
+}
+
+// MaybeVerify reports that cached was served from the cache for path.
+// Depending on the verify rate the keep then compares it to a fresh
+// copy in the background.
+func (k *Keep) MaybeVerify(path string, cached []byte) {
+	if k.readOnly || k.verifyRate <= 0 || rand.Float64() >= k.verifyRate {
+		return
+	}
+	k.spawner.spawn(func() { k.verify(path, cached) })
+}
+
+func (k *Keep) verify(path string, cached []byte) {
+	resp, err := k.cache.Fetch(k.upstreamPath(path))
+	if err != nil {
+		return
+	}
+	defer resp.Close()
+
+	buffer := new(bytes.Buffer)
+	_, err = io.Copy(buffer, resp)
+	if err != nil {
+		return
+	}
+	fresh, err := k.applyTransforms(path, buffer.Bytes())
+	if err != nil {
+		return
+	}
+
+	if !bytes.Equal(fresh, cached) {
+		fmt.Printf("cached data for %s differs from upstream\n", path)
+		k.sendDivergedKeepMessage(path)
+	}
+}
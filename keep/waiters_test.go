@@ -0,0 +1,45 @@
+package keep
+
+import (
+	"testing"
+	"time"
+)
+
+// BenchmarkNotifyWaiters measures how long the run loop takes to
+// process a finished fetch that many requests are waiting for, under
+// each strategy, as loop-ns/op.  Making the waiters' channels and
+// receiving from them isn't counted.  The channels are buffered like
+// those of tryLookup, so it's the fan-out that's measured, not the
+// receivers.
+func BenchmarkNotifyWaiters(b *testing.B) {
+	const n = 10000
+	for _, strategy := range []struct {
+		name     string
+		strategy WaiterStrategy
+	}{{"loop", WaitersInLoop}, {"async", WaitersAsync}} {
+		b.Run(strategy.name, func(b *testing.B) {
+			k := NewKeep(nil, 0, 5, 0)
+			k.SetWaiterStrategy(strategy.strategy, 0)
+			e := &entry{info: EntryInfo{Path: "/a", Count: 1}}
+			k.entries["/a"] = e
+			msg := fetchedKeepMessage{path: "/a", result: fetchResult{Data: []byte("data")}}
+			waiters := make([]chan fetchResult, n)
+			var busy time.Duration
+			for i := 0; i < b.N; i++ {
+				for j := range waiters {
+					waiters[j] = make(chan fetchResult, 1)
+					e.waiters = append(e.waiters, waiters[j])
+				}
+				e.info.Fetching = true
+				k.numFetching++
+				start := time.Now()
+				msg.process(k)
+				busy += time.Since(start)
+				for _, waiter := range waiters {
+					<-waiter
+				}
+			}
+			b.ReportMetric(float64(busy.Nanoseconds())/float64(b.N), "loop-ns/op")
+		})
+	}
+}
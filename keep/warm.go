@@ -0,0 +1,59 @@
+package keep
+
+import (
+	"sync"
+	"time"
+)
+
+// StageResult reports how warming a stage of paths went.
+type StageResult struct {
+	Stage    int
+	Paths    int
+	Failed   int
+	Duration time.Duration
+}
+
+// WarmStaged primes the paths of each stage, concurrency of them at a
+// time.  A stage starts only once all paths of the previous one are
+// done, whether they failed or not, so that paths which are cheaper to
+// fetch after others can be warmed after them.  onStage, if not nil, is
+// called after each stage.
+func (k *Keep) WarmStaged(stages [][]string, concurrency int, onStage func(result StageResult)) []StageResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var results []StageResult
+	for i, paths := range stages {
+		startTime := time.Now()
+		var mutex sync.Mutex
+		failed := 0
+		indexes := make(chan int)
+		var wg sync.WaitGroup
+		for j := 0; j < concurrency; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for index := range indexes {
+					if k.Prime(paths[index]) != nil {
+						mutex.Lock()
+						failed++
+						mutex.Unlock()
+					}
+				}
+			}()
+		}
+		for index := range paths {
+			indexes <- index
+		}
+		close(indexes)
+		wg.Wait()
+
+		result := StageResult{Stage: i, Paths: len(paths), Failed: failed, Duration: time.Now().Sub(startTime)}
+		results = append(results, result)
+		if onStage != nil {
+			onStage(result)
+		}
+	}
+	return results
+}
@@ -0,0 +1,102 @@
+package keep
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// A ContextWriter can abandon a write to the cache when ctx is done.
+type ContextWriter interface {
+	SetContext(ctx context.Context, path string, data []byte) error
+}
+
+// SetWriteTimeout bounds how long writes to the cache may take, if it's
+// a ContextWriter.  Writes that time out are counted in Stats.  Zero,
+// the default, doesn't bound them.  It must be called before Run.
+func (k *Keep) SetWriteTimeout(timeout time.Duration) {
+	k.writeTimeout = timeout
+}
+
+// A writeKeepMessage tells the loop that a write of fetched data to the
+// cache is done, or asks it whether one may start, which it may unless
+// the data was pushed since the fetch started.
+type writeKeepMessage struct {
+	path  string
+	done  bool
+	reply chan<- bool
+}
+
+func (k *Keep) sendWriteKeepMessage(path string, done bool, reply chan<- bool) {
+	msg := writeKeepMessage{path: path, done: done, reply: reply}
+	k.messageChannel <- &msg
+}
+
+func (msg *writeKeepMessage) process(k *Keep) {
+	e, ok := k.entries[msg.path]
+	if !msg.done {
+		allowed := !ok || e.pushes == e.fetchPushes
+		if ok && allowed {
+			e.writes++
+		}
+		msg.reply <- allowed
+		return
+	}
+	if !ok || e.writes == 0 {
+		// The entry was removed and added again since the
+		// write started.
+		return
+	}
+	e.writes--
+	if e.writes == 0 {
+		// The waiters that came too late to get the data can
+		// now read it from the cache, and pushes can write.
+		k.notifyTokenWaiters(e, fetchResult{})
+		for _, c := range e.pushWaiters {
+			c <- true
+		}
+		e.pushWaiters = nil
+	}
+}
+
+// startWrite returns whether the fetched data for path may be written
+// to the cache, and if so, the write must be finished with
+// finishWrite.
+func (k *Keep) startWrite(path string) bool {
+	c := make(chan bool, 1)
+	k.sendWriteKeepMessage(path, false, c)
+	return <-c
+}
+
+func (k *Keep) finishWrite(path string) {
+	k.sendWriteKeepMessage(path, true, nil)
+}
+
+// setData writes data for path to the cache.
+func (k *Keep) setData(path string, data []byte) error {
+	cw, ok := k.cache.(ContextWriter)
+	if !ok {
+		return k.cache.Set(path, data)
+	}
+
+	ctx := k.closed
+	if k.writeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, k.writeTimeout)
+		defer cancel()
+	}
+	err := cw.SetContext(ctx, path, data)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		fmt.Printf("cache set of %s timed out\n", path)
+		atomic.AddInt64(&k.writeTimeouts, 1)
+	}
+	return err
+}
+
+// Close abandons all writes to the cache that are still running, if
+// it's a ContextWriter, and makes all further ones fail.  The keep
+// must not be used after it's closed.
+func (k *Keep) Close() {
+	k.closeWrites()
+}
@@ -0,0 +1,70 @@
+package keep
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// blockingCache is a testCache whose writes block until their context
+// is done.
+type blockingCache struct {
+	*testCache
+	writing chan string
+	written chan error
+}
+
+func newBlockingCache() *blockingCache {
+	return &blockingCache{testCache: newTestCache(), writing: make(chan string, 10), written: make(chan error, 10)}
+}
+
+func (c *blockingCache) SetContext(ctx context.Context, path string, data []byte) error {
+	c.writing <- path
+	<-ctx.Done()
+	c.written <- ctx.Err()
+	return ctx.Err()
+}
+
+func (c *blockingCache) nextWritten(t *testing.T) error {
+	t.Helper()
+	select {
+	case err := <-c.written:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a write to end")
+	}
+	return nil
+}
+
+func TestWriteTimeout(t *testing.T) {
+	c := newBlockingCache()
+	k := newTestKeep(c, func(k *Keep) { k.SetWriteTimeout(20 * time.Millisecond) })
+
+	if result := request(k, "/a"); result.err != nil {
+		t.Fatal(result.err)
+	}
+	if err := c.nextWritten(t); err != context.DeadlineExceeded {
+		t.Errorf("write ended with %v", err)
+	}
+	eventually(t, "the timeout to be counted", func() bool { return k.Stats().WriteTimeouts == 1 })
+	if _, ok := c.stored("/a"); ok {
+		t.Error("stored data whose write timed out")
+	}
+}
+
+func TestCloseAbandonsWrites(t *testing.T) {
+	c := newBlockingCache()
+	k := newTestKeep(c, nil)
+
+	if result := request(k, "/a"); result.err != nil {
+		t.Fatal(result.err)
+	}
+	<-c.writing
+	k.Close()
+	if err := c.nextWritten(t); err != context.Canceled {
+		t.Errorf("write ended with %v", err)
+	}
+	if n := k.Stats().WriteTimeouts; n != 0 {
+		t.Errorf("%d writes timed out", n)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type clientWindow struct {
+	start time.Time
+	count int
+}
+
+// pathLimiter limits how many new paths a single client can register
+// within a time window.
+type pathLimiter struct {
+	mutex     sync.Mutex
+	max       int
+	window    time.Duration
+	clients   map[string]*clientWindow
+	lastPrune time.Time
+}
+
+func newPathLimiter(max int, window time.Duration) *pathLimiter {
+	return &pathLimiter{max: max,
+		window:    window,
+		clients:   make(map[string]*clientWindow),
+		lastPrune: time.Now()}
+}
+
+// allow returns whether client may register another new path, and
+// counts it if so.
+func (l *pathLimiter) allow(client string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastPrune) > l.window {
+		for c, cw := range l.clients {
+			if now.Sub(cw.start) > l.window {
+				delete(l.clients, c)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	cw, ok := l.clients[client]
+	if !ok || now.Sub(cw.start) > l.window {
+		cw = &clientWindow{start: now}
+		l.clients[client] = cw
+	}
+	if cw.count >= l.max {
+		return false
+	}
+	cw.count++
+	return true
+}
+
+// clientIdentity returns the address identifying the client of r.  If
+// header is given and present in the request, its last address is used
+// instead of the remote address.  That's the one the proxy in front of
+// us added, as for X-Forwarded-For, while the ones before it come from
+// the client, which could make them up to get around the limit.
+func clientIdentity(r *http.Request, header string) string {
+	if header != "" {
+		values := r.Header[http.CanonicalHeaderKey(header)]
+		if len(values) > 0 {
+			addresses := strings.Split(values[len(values)-1], ",")
+			if address := strings.TrimSpace(addresses[len(addresses)-1]); address != "" {
+				return address
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+const maxRequestWeight = 100
+
+// requestWeight returns the weight of r given in header, which is one
+// if there is no header or it's not a valid weight.
+func requestWeight(r *http.Request, header string) int {
+	if header == "" {
+		return 1
+	}
+	weight, err := strconv.Atoi(r.Header.Get(header))
+	if err != nil || weight < 1 {
+		return 1
+	}
+	if weight > maxRequestWeight {
+		return maxRequestWeight
+	}
+	return weight
+}
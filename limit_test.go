@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIdentity(t *testing.T) {
+	tests := []struct {
+		header []string
+		want   string
+	}{
+		{nil, "192.0.2.1"},
+		{[]string{"203.0.113.7"}, "203.0.113.7"},
+		// The client made up the first addresses, and the proxy
+		// added the last one.
+		{[]string{"10.0.0.1, 10.0.0.2, 203.0.113.7"}, "203.0.113.7"},
+		{[]string{"10.0.0.1", "203.0.113.7"}, "203.0.113.7"},
+		{[]string{"10.0.0.1, "}, "192.0.2.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/a", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		for _, value := range test.header {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if got := clientIdentity(r, "X-Forwarded-For"); got != test.want {
+			t.Errorf("%q: got %s, want %s", test.header, got, test.want)
+		}
+	}
+}
+
+func TestSpoofedForwardedForLimited(t *testing.T) {
+	limiter := newPathLimiter(2, time.Hour)
+	allowed := 0
+	for _, spoofed := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		r := httptest.NewRequest("GET", "/a", nil)
+		r.Header.Set("X-Forwarded-For", spoofed+", 203.0.113.7")
+		if limiter.allow(clientIdentity(r, "X-Forwarded-For")) {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("a client rotating spoofed addresses registered %d paths, want 2", allowed)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// maintenanceBody is served instead of fetching missing or expired
+// data while refreshes are paused, if it's not nil.
+var maintenanceBody []byte
+var maintenanceStatus = http.StatusServiceUnavailable
+var maintenanceRetryAfter = 60
+
+func serveMaintenance(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(maintenanceRetryAfter))
+	w.WriteHeader(maintenanceStatus)
+	_, err := w.Write(maintenanceBody)
+	if err != nil {
+		fmt.Printf("write error")
+	}
+}
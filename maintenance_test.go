@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMaintenanceWhilePaused(t *testing.T) {
+	c := newTestCache()
+	useKeep(t, c, 0)
+	maintenanceBody = []byte(`{"maintenance": true}`)
+	defer func() { maintenanceBody = nil }()
+
+	if w := serve(cacheHandler, "GET", "/fresh", ""); w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	eventually(t, "the data to be cached", func() bool {
+		_, err := c.Get("/fresh")
+		return err == nil
+	})
+	theKeep.Pause()
+
+	// Fresh data is served as usual,
+	w := serve(cacheHandler, "GET", "/fresh", "")
+	if w.Code != http.StatusOK || w.Body.String() != "data /fresh" {
+		t.Errorf("got status %d: %s", w.Code, w.Body)
+	}
+	// but missing data isn't fetched.
+	w = serve(cacheHandler, "GET", "/missing", "")
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != `{"maintenance": true}` ||
+		w.Header().Get("Retry-After") != "60" || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("got status %d, headers %v: %s", w.Code, w.Header(), w.Body)
+	}
+	if n := c.fetchCount("/missing"); n != 0 {
+		t.Errorf("%d fetches while paused", n)
+	}
+
+	theKeep.Resume()
+	if w := serve(cacheHandler, "GET", "/missing", ""); w.Code != http.StatusOK {
+		t.Errorf("got status %d after resuming", w.Code)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// A manifestParser returns the paths listed in a manifest.
+type manifestParser func(r io.Reader) ([]string, error)
+
+var manifestParsers = map[string]manifestParser{
+	"json":    parseJSONManifest,
+	"sitemap": parseSitemapManifest,
+}
+
+// parseJSONManifest parses a JSON array of paths, which are cached
+// under their request paths, like requested ones.
+func parseJSONManifest(r io.Reader) ([]string, error) {
+	var rawPaths []string
+	err := json.NewDecoder(r).Decode(&rawPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, rawPath := range rawPaths {
+		parsed, err := url.Parse(rawPath)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, requestPath(parsed))
+	}
+	return paths, nil
+}
+
+type sitemap struct {
+	URLs []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+}
+
+// parseSitemapManifest parses an XML sitemap.  Only the paths of the
+// listed URLs are used, not their hosts.
+func parseSitemapManifest(r io.Reader) ([]string, error) {
+	var sm sitemap
+	err := xml.NewDecoder(r).Decode(&sm)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, u := range sm.URLs {
+		parsed, err := url.Parse(u.Loc)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, requestPath(parsed))
+	}
+	return paths, nil
+}
+
+// manifestWatcher keeps the paths listed in a manifest registered in
+// the keep.
+type manifestWatcher struct {
+	url      string
+	parser   manifestParser
+	interval time.Duration
+	paths    map[string]bool
+}
+
+func newManifestWatcher(url string, parser manifestParser, interval time.Duration) *manifestWatcher {
+	return &manifestWatcher{url: url,
+		parser:   parser,
+		interval: interval,
+		paths:    make(map[string]bool)}
+}
+
+// sync registers the paths new in the manifest and unregisters the
+// ones no longer in it.
+func (m *manifestWatcher) sync() error {
+	resp, err := http.Get(m.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Manifest returned status %d", resp.StatusCode)
+	}
+
+	paths, err := m.parser(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]bool)
+	for _, path := range paths {
+		current[path] = true
+		if !m.paths[path] {
+			fmt.Printf("registering %s\n", path)
+			theKeep.Register(path)
+		}
+	}
+	for path := range m.paths {
+		if !current[path] {
+			fmt.Printf("unregistering %s\n", path)
+			theKeep.Unregister(path)
+		}
+	}
+	m.paths = current
+	return nil
+}
+
+func (m *manifestWatcher) run() {
+	for {
+		err := m.sync()
+		if err != nil {
+			fmt.Printf("manifest error: %s\n", err.Error())
+		}
+		time.Sleep(m.interval)
+	}
+}
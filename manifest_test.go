@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestManifestParsersNormalize(t *testing.T) {
+	normalizePaths = true
+	theQueryRule = queryRule{policy: queryIgnore}
+	defer func() {
+		normalizePaths = false
+		theQueryRule = queryRule{policy: queryExact}
+	}()
+
+	want := []string{"/a/b", "/c"}
+	paths, err := parseJSONManifest(strings.NewReader(`["/a//./b", "/c?utm=x"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("JSON manifest gave %v, want %v", paths, want)
+	}
+
+	paths, err = parseSitemapManifest(strings.NewReader(`<urlset>
+		<url><loc>https://example.com/a//./b</loc></url>
+		<url><loc>https://example.com/c?utm=x</loc></url>
+	</urlset>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("sitemap gave %v, want %v", paths, want)
+	}
+
+	if _, err := parseJSONManifest(strings.NewReader(`["%zz"]`)); err == nil {
+		t.Error("parsed a bad path")
+	}
+}
+
+func TestManifestWatcherSync(t *testing.T) {
+	useKeep(t, newTestCache(), 0)
+
+	var mu sync.Mutex
+	manifest := `["/a", "/b"]`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprint(w, manifest)
+	}))
+	defer server.Close()
+
+	m := newManifestWatcher(server.URL, parseJSONManifest, time.Hour)
+	if err := m.sync(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/a", "/b"} {
+		if !theKeep.Contains(path) {
+			t.Errorf("%s not registered", path)
+		}
+	}
+
+	mu.Lock()
+	manifest = `["/b"]`
+	mu.Unlock()
+	if err := m.sync(); err != nil {
+		t.Fatal(err)
+	}
+	for _, ei := range theKeep.Dump() {
+		if ei.Path == "/a" && (ei.Pinned || ei.Count > 0) {
+			t.Errorf("/a still registered: %+v", ei)
+		}
+		if ei.Path == "/b" && !ei.Pinned {
+			t.Errorf("/b not pinned: %+v", ei)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/schani/reloadcache/keep"
+)
+
+// metricsWriter writes metrics in the Prometheus text exposition
+// format.
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (mw metricsWriter) header(name string, kind string, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(mw.w, "# TYPE %s %s\n", name, kind)
+}
+
+func (mw metricsWriter) sample(name string, labels string, value float64) {
+	if labels != "" {
+		fmt.Fprintf(mw.w, "%s{%s} %g\n", name, labels, value)
+	} else {
+		fmt.Fprintf(mw.w, "%s %g\n", name, value)
+	}
+}
+
+func (mw metricsWriter) metric(name string, kind string, help string, value float64) {
+	mw.header(name, kind, help)
+	mw.sample(name, "", value)
+}
+
+func (mw metricsWriter) histogram(name string, help string, h keep.Histogram) {
+	mw.header(name, "histogram", help)
+	for i, bound := range h.Bounds {
+		mw.sample(name+"_bucket", fmt.Sprintf("le=\"%g\"", bound), float64(h.Counts[i]))
+	}
+	mw.sample(name+"_bucket", "le=\"+Inf\"", float64(h.Count))
+	mw.sample(name+"_sum", "", h.Sum)
+	mw.sample(name+"_count", "", float64(h.Count))
+}
+
+// labelValueEscaper escapes label values as the exposition format
+// wants, which is not how Go quotes strings.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promLabels formats labels for a sample, sorted by key.
+func promLabels(labels map[string]string) string {
+	var keys []string
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", key, labelValueEscaper.Replace(labels[key])))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := theKeep.Stats()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=UTF-8")
+	mw := metricsWriter{w: bufio.NewWriter(w)}
+
+	mw.metric("reloadcache_entries", "gauge", "Number of entries in the keep.", float64(stats.Entries))
+	mw.metric("reloadcache_fetching", "gauge", "Number of entries being fetched.", float64(stats.Fetching))
+	mw.metric("reloadcache_fetches_total", "counter", "Number of finished fetches.", float64(stats.Fetches))
+	mw.metric("reloadcache_fetch_errors_total", "counter", "Number of failed fetches.", float64(stats.FetchErrors))
+	mw.metric("reloadcache_refresh_interval_seconds", "gauge", "Current interval after which entries are refetched.", stats.RefreshInterval.Seconds())
+	mw.metric("reloadcache_degraded", "gauge", "Whether refreshes are paused because the upstream is failing.", boolMetric(stats.Degraded))
+	mw.metric("reloadcache_paused", "gauge", "Whether refreshes are paused by an operator.", boolMetric(stats.Paused))
+	mw.metric("reloadcache_goroutines", "gauge", "Number of goroutines running fetches and cache writes.", float64(stats.Goroutines))
+	mw.metric("reloadcache_queued_goroutines", "gauge", "Number of fetches and cache writes waiting for a goroutine.", float64(stats.QueuedGoroutines))
+	mw.metric("reloadcache_divergences_total", "counter", "Number of verified cache hits that were stale beyond their expire time.", float64(stats.Divergences))
+	mw.metric("reloadcache_bytes", "gauge", "Size of the data of all entries.", float64(stats.Bytes))
+	mw.metric("reloadcache_evictions_total", "counter", "Number of entries evicted to stay within the byte budget.", float64(stats.Evictions))
+	mw.metric("reloadcache_lost_total", "counter", "Number of times the data of an entry was missing from the cache.", float64(stats.Lost))
+	mw.metric("reloadcache_write_timeouts_total", "counter", "Number of writes to the cache that timed out.", float64(stats.WriteTimeouts))
+	mw.metric("reloadcache_hedges_total", "counter", "Number of hedged requests sent to the upstream.", float64(stats.Hedges))
+	mw.metric("reloadcache_hedge_wins_total", "counter", "Number of hedged requests that were faster than the first.", float64(stats.HedgeWins))
+	mw.metric("reloadcache_skipped_refreshes_total", "counter", "Number of refreshes left to other instances.", float64(stats.SkippedRefreshes))
+	mw.metric("reloadcache_hits_total", "counter", "Number of requests served from the cache, each saving an upstream fetch.", float64(stats.Hits))
+	mw.metric("reloadcache_saved_bytes_total", "counter", "Estimated number of upstream bytes saved by cache hits.", float64(stats.BytesSaved))
+	mw.metric("reloadcache_slow_entries", "gauge", "Number of entries whose fetches are slow.", float64(stats.SlowEntries))
+	mw.histogram("reloadcache_response_size_bytes", "Sizes of fetched bodies.", stats.ResponseSizes)
+	mw.histogram("reloadcache_fetch_duration_seconds", "Durations of finished fetches.", stats.FetchDurations)
+	mw.histogram("reloadcache_freshness", "Ages of the data of entries as fractions of their refetch interval.", theKeep.Freshness())
+	if len(stats.Upstreams) > 0 {
+		mw.header("reloadcache_upstream_fetches_total", "counter", "Number of fetches served by each upstream.")
+		for upstream, n := range stats.Upstreams {
+			mw.sample("reloadcache_upstream_fetches_total", promLabels(map[string]string{"upstream": upstream}), float64(n))
+		}
+	}
+
+	if len(stats.Labels) > 0 {
+		mw.header("reloadcache_labeled_fetches_total", "counter", "Number of finished fetches by entry labels.")
+		for _, ls := range stats.Labels {
+			mw.sample("reloadcache_labeled_fetches_total", promLabels(ls.Labels), float64(ls.Fetches))
+		}
+		mw.header("reloadcache_labeled_fetch_errors_total", "counter", "Number of failed fetches by entry labels.")
+		for _, ls := range stats.Labels {
+			mw.sample("reloadcache_labeled_fetch_errors_total", promLabels(ls.Labels), float64(ls.FetchErrors))
+		}
+		mw.header("reloadcache_labeled_fetch_seconds_total", "counter", "Total duration of fetches by entry labels.")
+		for _, ls := range stats.Labels {
+			mw.sample("reloadcache_labeled_fetch_seconds_total", promLabels(ls.Labels), ls.FetchDuration.Seconds())
+		}
+	}
+
+	err := mw.w.Flush()
+	if err != nil {
+		fmt.Printf("write error")
+	}
+}
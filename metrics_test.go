@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/schani/reloadcache/keep"
+)
+
+func TestPromLabels(t *testing.T) {
+	for _, test := range []struct {
+		labels map[string]string
+		want   string
+	}{
+		{nil, ""},
+		{map[string]string{"b": "2", "a": "1"}, `a="1",b="2"`},
+		{map[string]string{"path": `C:\dir`}, `path="C:\\dir"`},
+		{map[string]string{"q": `say "hi"`}, `q="say \"hi\""`},
+		{map[string]string{"lines": "a\nb"}, `lines="a\nb"`},
+		// Only those three are escaped, unlike in Go strings.
+		{map[string]string{"name": "Zürich\tcafé"}, "name=\"Zürich\tcafé\""},
+	} {
+		if got := promLabels(test.labels); got != test.want {
+			t.Errorf("%v: got %s, want %s", test.labels, got, test.want)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	theKeep = keep.NewKeep(newTestCache(), time.Hour, 5, 0)
+	if err := theKeep.SetStatsLabels([]string{"team"}, 10); err != nil {
+		t.Fatal(err)
+	}
+	go theKeep.Run()
+	theKeep.RegisterWithLabels("/a", map[string]string{"team": "a\"b\\c\nd"})
+	eventually(t, "the fetch", func() bool { return theKeep.Stats().Fetches == 1 })
+
+	w := serve(metricsHandler, "GET", "/metrics", "")
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE reloadcache_fetches_total counter\nreloadcache_fetches_total 1\n",
+		"reloadcache_labeled_fetches_total{team=\"a\\\"b\\\\c\\nd\"} 1\n",
+		"reloadcache_fetch_duration_seconds_bucket{le=\"+Inf\"} 1\n",
+		"reloadcache_fetch_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q:\n%s", want, body)
+		}
+	}
+	if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("got Content-Type %s", contentType)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"sync"
+)
+
+// normalizePaths is whether request paths are normalized before
+// they're cached under them, so that e.g. /a//b and /a/./b share the
+// entry of /a/b.  Some origins treat such paths differently, which is
+// why it's optional.
+var normalizePaths bool
+
+// fetchOriginalPaths is whether a normalized path is fetched from the
+// server as it was first requested, instead of normalized.
+var fetchOriginalPaths bool
+
+// originalPaths maps normalized paths, including the query, to how
+// they were first requested, if that was different.
+var originalPaths sync.Map
+
+// normalizePath collapses duplicate slashes in p and resolves dot
+// segments, as in RFC 3986.  A trailing slash is kept.
+func normalizePath(p string) string {
+	if p == "" {
+		return p
+	}
+	normalized := path.Clean("/" + p)
+	if normalized != "/" && (strings.HasSuffix(p, "/") || strings.HasSuffix(p, "/.") || strings.HasSuffix(p, "/..")) {
+		normalized += "/"
+	}
+	return normalized
+}
+
+// rememberOriginalPath records that original was requested as
+// normalized, for fetching it as requested.
+func rememberOriginalPath(normalized string, original string) {
+	if fetchOriginalPaths && normalized != original {
+		originalPaths.LoadOrStore(normalized, original)
+	}
+}
+
+// upstreamPath returns the path to fetch from the server for the
+// normalized path p.
+func upstreamPath(p string) string {
+	original, ok := originalPaths.Load(p)
+	if !ok {
+		return p
+	}
+	return original.(string)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", ""},
+		{"/", "/"},
+		{"/a/b", "/a/b"},
+		{"/a//b", "/a/b"},
+		{"//a///b//", "/a/b/"},
+		{"/a/./b", "/a/b"},
+		{"/a/b/../c", "/a/c"},
+		{"/../../a", "/a"},
+		{"/a/b/.", "/a/b/"},
+		{"/a/b/..", "/a/"},
+		{"/..", "/"},
+		{"a/b", "/a/b"},
+	}
+	for _, test := range tests {
+		if got := normalizePath(test.path); got != test.want {
+			t.Errorf("%q normalized to %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestRequestPathNormalized(t *testing.T) {
+	normalizePaths = true
+	defer func() { normalizePaths = false }()
+
+	for _, request := range []string{"/a/b?x=1", "/a//b?x=1", "/a/./b?x=1", "/a/c/../b?x=1"} {
+		u, _ := url.Parse(request)
+		if got := requestPath(u); got != "/a/b?x=1" {
+			t.Errorf("%s is cached as %s", request, got)
+		}
+	}
+
+	normalizePaths = false
+	u, _ := url.Parse("/a//b")
+	if got := requestPath(u); got != "/a//b" {
+		t.Errorf("without normalizing, /a//b is cached as %s", got)
+	}
+}
+
+func TestFetchOriginalPaths(t *testing.T) {
+	normalizePaths = true
+	fetchOriginalPaths = true
+	defer func() {
+		normalizePaths = false
+		fetchOriginalPaths = false
+		originalPaths.Range(func(key, _ interface{}) bool {
+			originalPaths.Delete(key)
+			return true
+		})
+	}()
+
+	for _, request := range []string{"/x//y?q=1", "/x/./y?q=1", "/z"} {
+		u, _ := url.Parse(request)
+		requestPath(u)
+	}
+	// The path is fetched as it was first requested.
+	if got := upstreamPath("/x/y?q=1"); got != "/x//y?q=1" {
+		t.Errorf("/x/y?q=1 is fetched as %s", got)
+	}
+	if got := upstreamPath("/z"); got != "/z" {
+		t.Errorf("/z is fetched as %s", got)
+	}
+	if got := upstreamPath("/never"); got != "/never" {
+		t.Errorf("/never is fetched as %s", got)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// pollPath is where clients long-poll for data they were served the
+// stub for.
+const pollPath = "/_reloadcache/poll"
+
+// stubBody is served right away for missing data to requests that
+// prefer to respond asynchronously, if it's not nil.  The data is
+// fetched in the background, and the client can long-poll for it.
+var stubBody []byte
+
+// pollTimeout is the longest a long-poll waits for data.
+var pollTimeout = 30 * time.Second
+
+// prefersAsync returns whether the client asked for an asynchronous
+// response, as in RFC 7240.
+func prefersAsync(r *http.Request) bool {
+	for _, preference := range r.Header["Prefer"] {
+		if preference == "respond-async" {
+			return true
+		}
+	}
+	return false
+}
+
+// pollURL returns the URL to long-poll for data for path that's
+// fetched after since.
+func pollURL(path string, since time.Time) string {
+	query := url.Values{}
+	query.Set("path", path)
+	query.Set("since", strconv.FormatInt(since.UnixNano(), 10))
+	return pollPath + "?" + query.Encode()
+}
+
+// serveStub serves the stub for path and fetches it in the background.
+func serveStub(w http.ResponseWriter, path string) {
+	since := time.Now()
+	go func() {
+		_, err := theKeep.WaitOrFetch(path, func(cacheWriter io.Writer) io.Writer { return cacheWriter })
+		if err != nil {
+			fmt.Printf("background fetch error for %s\n", path)
+		}
+	}()
+
+	w.Header().Set("Location", pollURL(path, since))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusAccepted)
+	_, err := w.Write(stubBody)
+	if err != nil {
+		fmt.Printf("write error")
+	}
+}
+
+// pollHandler waits for the path given in the path parameter to be
+// fetched after the time in the since parameter, in nanoseconds since
+// the epoch, and serves the data.  Without since it waits for the next
+// fetch.  If there's no fetch within the poll timeout, the status is
+// No Content.
+func pollHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.FormValue("path")
+	if path == "" {
+		http.Error(w, "path parameter required", http.StatusBadRequest)
+		return
+	}
+	since := time.Now()
+	if r.FormValue("since") != "" {
+		nanos, err := strconv.ParseInt(r.FormValue("since"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+		since = time.Unix(0, nanos)
+	}
+
+	data, ok := theKeep.WaitForFetch(path, since, pollTimeout)
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if data == nil {
+		var err error
+		data, err = theCache.Get(path)
+		if err != nil {
+			// It was lost again, or not cached at all.
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	etag := theKeep.ETag(path)
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	_, err := w.Write(data)
+	if err != nil {
+		fmt.Printf("write error")
+	}
+}
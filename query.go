@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// queryPolicy determines how the query of a request affects the path
+// it's cached under, which is also the path fetched from the server.
+type queryPolicy int
+
+const (
+	// Every distinct query makes a distinct entry.
+	queryExact queryPolicy = iota
+	// The query is dropped, so all queries share one entry.
+	queryIgnore
+	// Only the allowed parameters are kept.
+	queryAllowlist
+)
+
+type queryRule struct {
+	policy queryPolicy
+	params map[string]bool
+}
+
+var theQueryRule = queryRule{policy: queryExact}
+
+// pathQueryRule is an allowlist rule for the paths matching pattern,
+// as in path.Match.
+type pathQueryRule struct {
+	pattern string
+	rule    queryRule
+}
+
+// thePathQueryRules override theQueryRule for the paths they match.
+// The first matching rule applies.
+var thePathQueryRules []pathQueryRule
+
+func parseQueryRule(policy string, params string) (queryRule, error) {
+	rule := queryRule{params: make(map[string]bool)}
+	switch policy {
+	case "exact":
+		rule.policy = queryExact
+	case "ignore":
+		rule.policy = queryIgnore
+	case "allowlist":
+		rule.policy = queryAllowlist
+	default:
+		return rule, fmt.Errorf("Unknown query policy %s", policy)
+	}
+	if params != "" {
+		for _, param := range strings.Split(params, ",") {
+			rule.params[param] = true
+		}
+	}
+	return rule, nil
+}
+
+// parsePathQueryRules parses rules of the form
+// "/search=q,page;/products/*=id", each giving the query parameters
+// kept for the paths matching its pattern.
+func parsePathQueryRules(rules string) ([]pathQueryRule, error) {
+	var pathRules []pathQueryRule
+	for _, rule := range strings.Split(rules, ";") {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid query rule %s", rule)
+		}
+		_, err := path.Match(parts[0], "")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern in query rule %s", rule)
+		}
+		queryRule, err := parseQueryRule("allowlist", parts[1])
+		if err != nil {
+			return nil, err
+		}
+		pathRules = append(pathRules, pathQueryRule{pattern: parts[0], rule: queryRule})
+	}
+	return pathRules, nil
+}
+
+// queryRuleFor returns the rule for the query of requests for p.
+func queryRuleFor(p string) queryRule {
+	for _, pathRule := range thePathQueryRules {
+		matched, _ := path.Match(pathRule.pattern, p)
+		if matched {
+			return pathRule.rule
+		}
+	}
+	return theQueryRule
+}
+
+// query returns the query to cache u under, without the question
+// mark.
+func (rule queryRule) query(u *url.URL) string {
+	switch rule.policy {
+	case queryIgnore:
+		return ""
+	case queryAllowlist:
+		values := u.Query()
+		for param := range values {
+			if !rule.params[param] {
+				delete(values, param)
+			}
+		}
+		return values.Encode()
+	}
+	return u.RawQuery
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestQueryPolicies(t *testing.T) {
+	defer func() { theQueryRule = queryRule{policy: queryExact} }()
+
+	requests := []string{"/items", "/items?sort=asc", "/items?utm=x&sort=asc"}
+	tests := []struct {
+		policy string
+		params string
+		want   []string
+	}{
+		{"exact", "", []string{"/items", "/items?sort=asc", "/items?utm=x&sort=asc"}},
+		{"ignore", "", []string{"/items", "/items", "/items"}},
+		{"allowlist", "sort", []string{"/items", "/items?sort=asc", "/items?sort=asc"}},
+	}
+	for _, test := range tests {
+		var err error
+		theQueryRule, err = parseQueryRule(test.policy, test.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, request := range requests {
+			u, _ := url.Parse(request)
+			if got := requestPath(u); got != test.want[i] {
+				t.Errorf("%s: %s is cached as %s, want %s", test.policy, request, got, test.want[i])
+			}
+		}
+	}
+
+	if _, err := parseQueryRule("fuzzy", ""); err == nil {
+		t.Error("parsed an unknown policy")
+	}
+}
+
+func TestIgnoredQueriesShareEntry(t *testing.T) {
+	defer func() { theQueryRule = queryRule{policy: queryExact} }()
+	theQueryRule, _ = parseQueryRule("ignore", "")
+	c := newTestCache()
+	useKeep(t, c, 0)
+
+	for _, target := range []string{"/items", "/items?sort=asc"} {
+		if w := serve(cacheHandler, "GET", target, ""); w.Code != http.StatusOK || w.Body.String() != "data /items" {
+			t.Errorf("%s: got status %d: %s", target, w.Code, w.Body)
+		}
+		eventually(t, "the data to be cached", func() bool {
+			_, err := c.Get("/items")
+			return err == nil
+		})
+	}
+	if n := c.fetchCount("/items"); n != 1 {
+		t.Errorf("%d fetches of the shared entry", n)
+	}
+	if n := c.fetchCount("/items?sort=asc"); n != 0 {
+		t.Error("fetched the query")
+	}
+}
+
+func TestPathQueryRules(t *testing.T) {
+	defer func() { thePathQueryRules = nil }()
+	var err error
+	thePathQueryRules, err = parsePathQueryRules("/search=q,page;/products/*=id")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		request string
+		want    string
+	}{
+		{"/search?q=shoes&utm_source=mail&page=2", "/search?page=2&q=shoes"},
+		{"/search?utm_source=mail", "/search"},
+		{"/products/7?id=1&ref=x", "/products/7?id=1"},
+		// Unmatched paths fall back to the global rule.
+		{"/page?utm_source=mail", "/page?utm_source=mail"},
+		{"/products/7/reviews?id=1&ref=x", "/products/7/reviews?id=1&ref=x"},
+	}
+	for _, test := range tests {
+		u, _ := url.Parse(test.request)
+		if got := requestPath(u); got != test.want {
+			t.Errorf("%s is cached as %s, want %s", test.request, got, test.want)
+		}
+	}
+
+	for _, rules := range []string{"/search", "=q", "/[=q"} {
+		if _, err := parsePathQueryRules(rules); err == nil {
+			t.Errorf("parsed %q", rules)
+		}
+	}
+}
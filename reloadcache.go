@@ -1,13 +1,28 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"hash"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,30 +34,228 @@ import (
 type memcacheCache struct {
 	c      *memcache.Client
 	server string
+	// fallbacks are tried in order when server fails.
+	fallbacks []string
+	client    *http.Client
+	// If the server doesn't send a Content-Type, check whether
+	// the body is JSON instead of rejecting it.
+	sniffJSON bool
+	// sniffLength is how many bytes of the body are sniffed.
+	sniffLength int
 }
 
 var theKeep *keep.Keep
-var theMemcache *memcache.Client
+var theCache keep.Cache
+var thePathLimiter *pathLimiter
+var clientHeader string
+var weightHeader string
+var theEncodings []string
+var readOnlyStatus = http.StatusNotFound
 
-func (c memcacheCache) Fetch(path string) (io.ReadCloser, error) {
-	req, err := http.NewRequest("GET", c.server+path, nil)
+// serveGrace is how long after expiring data is still served from the
+// cache.  If it's negative, cached data is always served.
+var serveGrace time.Duration = -1
+
+// tokenWait is how long a request with a refresh token waits for the
+// refreshed data before it's served what's in the cache.
+var tokenWait = 10 * time.Second
+
+// serveRevalidating is whether data past the grace is still served
+// while a refresh checks its validator.
+var serveRevalidating bool
+
+var errExpired = errors.New("Data in cache has expired")
+
+var debugLogger *log.Logger
+
+func debugf(format string, v ...interface{}) {
+	if debugLogger != nil {
+		debugLogger.Printf(format, v...)
+	}
+}
+
+// request fetches path from the server with method, or from the
+// fallbacks in order if it fails or returns a server error.  It also returns the server
+// that the response is from.  If encoding is given we ask for it, in
+// which case the body is not decoded.
+func (c memcacheCache) request(ctx context.Context, method string, path string, encoding string) (*http.Response, string, error) {
+	var err error
+	for _, server := range append([]string{c.server}, c.fallbacks...) {
+		var resp *http.Response
+		resp, err = c.requestFrom(ctx, method, server, path, encoding)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			resp.Body.Close()
+			err = &keep.UpstreamError{Status: resp.StatusCode, Err: fmt.Errorf("Server returned status %d", resp.StatusCode)}
+			continue
+		}
+		return resp, server, nil
+	}
+	return nil, "", err
+}
+
+func (c memcacheCache) requestFrom(ctx context.Context, method string, server string, path string, encoding string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, server+path, nil)
 	if err != nil {
 		fmt.Printf("request construction error\n")
 		return nil, err
 	}
+	if encoding != "" {
+		req.Header.Set("Accept-Encoding", encoding)
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.client.Do(req)
 	if err != nil {
 		fmt.Printf("request error\n")
-		return nil, err
+		netErr, ok := err.(net.Error)
+		return nil, &keep.UpstreamError{Timeout: ok && netErr.Timeout(), Err: err}
+	}
+	if method == "HEAD" {
+		// There's no body to check.
+		return resp, nil
 	}
 
-	if strings.Split(resp.Header.Get("Content-Type"), ";")[0] != "application/json" {
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" && c.sniffJSON && resp.Header.Get("Content-Encoding") == "" {
+		return sniffJSON(resp, c.sniffLength)
+	}
+	// ParseMediaType lowercases the type.  If it can't parse it
+	// we treat it as unknown.
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/json" {
 		fmt.Printf("not JSON: %s\n", resp.Header)
+		resp.Body.Close()
 		return nil, errors.New("Endpoint does not return JSON")
 	}
 
-	return resp.Body, nil
+	return resp, nil
+}
+
+// sniffJSON reads the first length bytes of the body of resp and
+// returns resp if they look like JSON.  Only a body that's shorter is
+// validated completely, so that large bodies are neither buffered nor
+// read twice.
+func sniffJSON(resp *http.Response, length int) (*http.Response, error) {
+	reader := bufio.NewReaderSize(resp.Body, length)
+	prefix, err := reader.Peek(length)
+	complete := err == io.EOF
+	if err != nil && !complete {
+		resp.Body.Close()
+		return nil, err
+	}
+	if !looksLikeJSON(prefix, complete) {
+		fmt.Printf("no Content-Type and not JSON\n")
+		resp.Body.Close()
+		return nil, errors.New("Endpoint does not return JSON")
+	}
+	resp.Body = readCloser{Reader: reader, Closer: resp.Body}
+	return resp, nil
+}
+
+// looksLikeJSON returns whether prefix is the start of a JSON value,
+// or a complete one if complete is true.
+func looksLikeJSON(prefix []byte, complete bool) bool {
+	if complete {
+		return json.Valid(prefix)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(prefix))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// It's cut off, but valid so far.
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// upstreamBody is a response body along with its response.
+type upstreamBody struct {
+	io.ReadCloser
+	resp   *http.Response
+	server string
+}
+
+func (b upstreamBody) Validator() string {
+	return validatorOf(b.resp.Header)
+}
+
+func (b upstreamBody) StatusCode() int {
+	return b.resp.StatusCode
+}
+
+func (b upstreamBody) Header() http.Header {
+	return b.resp.Header
+}
+
+func (b upstreamBody) Upstream() string {
+	return b.server
+}
+
+// validatorOf returns the ETag of a response, or its Last-Modified
+// if it has no ETag.
+func validatorOf(header http.Header) string {
+	etag := header.Get("ETag")
+	if etag != "" {
+		return etag
+	}
+	return header.Get("Last-Modified")
+}
+
+func (c memcacheCache) Fetch(path string) (io.ReadCloser, error) {
+	return c.FetchContext(context.Background(), path)
+}
+
+func (c memcacheCache) FetchContext(ctx context.Context, path string) (io.ReadCloser, error) {
+	resp, server, err := c.request(ctx, "GET", path, "")
+	if err != nil {
+		return nil, err
+	}
+	return upstreamBody{ReadCloser: resp.Body, resp: resp, server: server}, nil
+}
+
+func (c memcacheCache) Validator(path string) (string, error) {
+	return c.ValidatorContext(context.Background(), path)
+}
+
+// ValidatorContext asks the upstreams for the validator of path with a
+// HEAD request, falling back like fetches do.
+func (c memcacheCache) ValidatorContext(ctx context.Context, path string) (string, error) {
+	resp, _, err := c.request(ctx, "HEAD", path, "")
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HEAD returned status %d", resp.StatusCode)
+	}
+	return validatorOf(resp.Header), nil
+}
+
+func (c memcacheCache) FetchEncoded(path string, encoding string) (io.ReadCloser, string, error) {
+	resp, server, err := c.request(context.Background(), "GET", path, encoding)
+	if err != nil {
+		return nil, "", err
+	}
+	return upstreamBody{ReadCloser: resp.Body, resp: resp, server: server}, resp.Header.Get("Content-Encoding"), nil
+}
+
+func (c memcacheCache) Get(path string) ([]byte, error) {
+	item, err := c.c.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	return item.Value, nil
 }
 
 func (c memcacheCache) Set(path string, data []byte) error {
@@ -53,18 +266,117 @@ func (c memcacheCache) Delete(path string) error {
 	return c.c.Delete(path)
 }
 
+// requestPath returns the path, including the query, under which u is
+// cached.
+func requestPath(u *url.URL) string {
+	path := u.Path
+	original := path
+	if normalizePaths {
+		path = normalizePath(path)
+	}
+	query := queryRuleFor(path).query(u)
+	if query != "" {
+		path = path + "?" + query
+		original = original + "?" + query
+	}
+	rememberOriginalPath(path, original)
+	return path
+}
+
+// acceptsEncoding returns whether the client accepts encoding.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(accepted, ";")
+		if strings.TrimSpace(parts[0]) != encoding {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			q, err := strconv.ParseFloat(param[2:], 64)
+			if err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// staleWarning returns the Warning header for serving the data for
+// path, or the empty string if it's fresh.  Data is stale if it
+// expired, or if refreshing it failed, in which case it's not refetched
+// until it expires again.
+func staleWarning(path string, expired bool) string {
+	if theKeep.Failing(path) {
+		return `111 reloadcache "Revalidation Failed"`
+	}
+	if expired {
+		return `110 reloadcache "Response is Stale"`
+	}
+	return ""
+}
+
+// etagHashes are the hashes ETags can be computed with.
+var etagHashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"sha1":   sha1.New,
+	"fnv":    fnv.New128a,
+}
+
+// waiterStrategies are the strategies for handing fetch results to
+// waiting requests, by name.
+var waiterStrategies = map[string]keep.WaiterStrategy{
+	"loop":  keep.WaitersInLoop,
+	"async": keep.WaitersAsync,
+	"shed":  keep.WaitersShed,
+}
+
+// evictionPolicies are the eviction policies, by name.
+var evictionPolicies = map[string]keep.EvictionPolicy{
+	"lru":  keep.EvictLRU,
+	"lfu":  keep.EvictLFU,
+	"size": keep.EvictLargest,
+	"cost": keep.EvictCost,
+}
+
+// etagMatches returns whether the If-None-Match header ifNoneMatch
+// matches etag, using weak comparison.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
 func cacheHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "" && r.Method != "GET" {
 		http.Error(w, "Only GET method supported", http.StatusBadRequest)
 		return
 	}
 
-	path := r.URL.Path
-	if r.URL.RawQuery != "" {
-		path = path + "?" + r.URL.RawQuery
-	}
+	path := requestPath(r.URL)
 	fmt.Printf("request for %s\n", path)
-	theKeep.PathRequested(path)
+
+	if thePathLimiter != nil && !theKeep.Contains(path) {
+		client := clientIdentity(r, clientHeader)
+		if !thePathLimiter.allow(client) {
+			fmt.Printf("too many new paths from %s\n", client)
+			http.Error(w, "Too many new paths requested", http.StatusTooManyRequests)
+			return
+		}
+	}
+	theKeep.PathRequestedWithWeight(path, requestWeight(r, weightHeader))
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
@@ -73,15 +385,124 @@ func cacheHandler(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", origin)
 	}
 
-	var data []byte
-	item, err := theMemcache.Get(path)
+	for name, values := range theKeep.Header(path) {
+		w.Header()[name] = values
+	}
+
+	if tokenHeader := r.Header.Get("X-Refresh-Token"); tokenHeader != "" {
+		token, err := strconv.ParseUint(tokenHeader, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid X-Refresh-Token", http.StatusBadRequest)
+			return
+		}
+		data, ok := theKeep.WaitForToken(path, keep.Token(token), tokenWait)
+		if !ok {
+			fmt.Printf("gave up waiting for refresh of %s\n", path)
+		} else if data != nil {
+			_, err = w.Write(data)
+			if err != nil {
+				fmt.Printf("write error")
+			}
+			return
+		}
+	}
+
+	// Data past the grace or its maximum served age is not served
+	// from the cache, but fetched.
+	expiredBy, overMaxAge := theKeep.Staleness(path)
+	expired := overMaxAge || serveGrace >= 0 && expiredBy > serveGrace
+	if expired && !overMaxAge && serveRevalidating && theKeep.Revalidating(path) {
+		// Only blocking if we don't have the data at all.
+		fmt.Printf("serving %s during revalidation\n", path)
+		expired = false
+	}
+	if serveGrace >= 0 {
+		if expiredBy > 0 && !expired {
+			if debugLogger != nil {
+				debugf("STALE %s, expired %s ago", path, expiredBy)
+			}
+			theKeep.RefreshStale(path)
+		}
+	}
+
+	// Expired data is only served from the cache if it's stale.
+	stale := expiredBy > 0 && !expired
+
+	// The ETag is the same for all encodings, so we can do this
+	// before picking one.  The gzip handler adds the Vary header.
+	etag := theKeep.ETag(path)
+	if etag != "" && !expired {
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.Header().Set("ETag", etag)
+			w.Header().Del("Content-Type")
+			w.WriteHeader(http.StatusNotModified)
+			theKeep.Hit(path)
+			return
+		}
+	}
+
+	for _, encoding := range theEncodings {
+		if expired || !acceptsEncoding(r, encoding) {
+			continue
+		}
+		theKeep.VariantRequested(path, encoding)
+		data, err := theCache.Get(keep.VariantKey(path, encoding))
+		if err != nil {
+			continue
+		}
+		fmt.Printf("found %s variant in cache %s\n", encoding, path)
+		if debugLogger != nil {
+			debugf("HIT %s %s", path, encoding)
+		}
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		if warning := staleWarning(path, stale); warning != "" {
+			w.Header().Set("Warning", warning)
+		}
+		w.Header().Set("Content-Encoding", encoding)
+		theKeep.Hit(path)
+		_, err = w.Write(data)
+		if err != nil {
+			fmt.Printf("write error")
+		}
+		return
+	}
+
+	writerMade := false
+	data, err := theCache.Get(path)
+	if err == nil && expired {
+		fmt.Printf("expired in cache %s\n", path)
+		err = errExpired
+	}
 	if err == nil {
 		fmt.Printf("found in cache %s\n", path)
-		data = item.Value
+		if debugLogger != nil {
+			debugf("HIT %s", path)
+		}
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		if warning := staleWarning(path, stale); warning != "" {
+			w.Header().Set("Warning", warning)
+		}
+		theKeep.Hit(path)
+		theKeep.MaybeVerify(path, data)
 	} else {
 		fmt.Printf("not in cache - requesting %s\n", path)
+		if debugLogger != nil {
+			debugf("MISS %s: %s", path, err)
+		}
+
+		if maintenanceBody != nil && theKeep.Paused() {
+			serveMaintenance(w)
+			return
+		}
+		if stubBody != nil && prefersAsync(r) {
+			serveStub(w, path)
+			return
+		}
 
-		writerMade := false
 		data, err = theKeep.WaitOrFetch(path, func(cacheWriter io.Writer) io.Writer {
 			writerMade = true
 			w.WriteHeader(http.StatusOK)
@@ -89,12 +510,30 @@ func cacheHandler(w http.ResponseWriter, r *http.Request) {
 		})
 		if err != nil {
 			if !writerMade {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+				status := http.StatusBadRequest
+				if upstreamErr, ok := err.(*keep.UpstreamError); ok {
+					status = http.StatusBadGateway
+					if upstreamErr.Timeout {
+						status = http.StatusGatewayTimeout
+					}
+					w.Header().Set("X-Upstream-Error", upstreamErr.Error())
+				} else if err == keep.ErrTooManyWaiters || err == keep.ErrPaused {
+					status = http.StatusServiceUnavailable
+				} else if err == keep.ErrReadOnly {
+					status = readOnlyStatus
+				}
+				http.Error(w, err.Error(), status)
 			}
 			return
 		}
 	}
 
+	if !writerMade && len(data) == 0 && theKeep.EmptyBodyPolicy() == keep.EmptyBodyNoContent {
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
 	_, err = w.Write(data)
 	if err != nil {
 		fmt.Printf("write error")
@@ -118,6 +557,13 @@ func (infos entryInfos) Swap(i, j int) {
 	infos[j] = tmp
 }
 
+func yesNo(b bool) string {
+	if b {
+		return "Yes"
+	}
+	return "No"
+}
+
 func keepHandler(w http.ResponseWriter, r *http.Request) {
 	infos := entryInfos(theKeep.Dump())
 	sort.Sort(infos)
@@ -125,54 +571,400 @@ func keepHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 
 	fmt.Fprintf(w, "<html><body><table>\n")
-	fmt.Fprintf(w, "<tr><th>Path</th><th>Count</th><th>Last fetched</th><th>Last duration</th><th>Last error</th><th>Fetching?</th></tr>")
+	fmt.Fprintf(w, "<tr><th>Path</th><th>Count</th><th>Last fetched</th><th>Last duration</th><th>Last error</th><th>Failed at</th><th>Fetching?</th><th>Pinned?</th><th>Requests</th><th>Weight</th><th>Variants</th><th>Next refresh</th></tr>")
 	for _, ei := range infos {
-		var fetchingString string
-		if ei.Fetching {
-			fetchingString = "Yes"
-		} else {
-			fetchingString = "No"
-		}
 		errorString := ""
+		errorTime := ""
 		if ei.LastErr != nil {
 			errorString = ei.LastErr.Error()
+			errorTime = ei.LastErrTime.String()
 		}
-		fmt.Fprintf(w, "<tr><td>%s</td><td>%d</td><td>%s</td><td>%.1fs</td><td>%s</td><td>%s</td></tr>\n",
-			ei.Path, ei.Count, ei.LastFetched, ei.LastDuration.Seconds(), errorString, fetchingString)
+		nextRefresh := ""
+		if !ei.NextRefresh.IsZero() {
+			nextRefresh = ei.NextRefresh.String()
+		}
+		fmt.Fprintf(w, "<tr><td>%s</td><td>%d</td><td>%s</td><td>%.1fs</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%d</td><td>%d</td><td>%d</td><td>%s</td></tr>\n",
+			ei.Path, ei.Count, ei.LastFetched, ei.LastDuration.Seconds(), errorString, errorTime, yesNo(ei.Fetching), yesNo(ei.Pinned), ei.Requests, ei.Weight, ei.Variants, nextRefresh)
 	}
 	fmt.Fprintf(w, "</table></body></html>\n")
 }
 
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err := json.NewEncoder(w).Encode(theKeep.Stats())
+	if err != nil {
+		fmt.Printf("write error")
+	}
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	status := "ok"
+	stats := theKeep.Stats()
+	if stats.Paused {
+		status = "paused"
+	} else if stats.Degraded {
+		status = "degraded"
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err := json.NewEncoder(w).Encode(map[string]string{"status": status})
+	if err != nil {
+		fmt.Printf("write error")
+	}
+}
+
 func main() {
 	memcacheFlag := flag.String("memcache", "localhost:11211", "memcached host and port")
+	instancesFlag := flag.Int("instances", 1, "number of instances sharing memcached, each doing a random share of the refreshes")
+	namespaceFlag := flag.String("namespace", "", "prefix for all memcached keys, to share memcached with other instances")
+	memcacheReadFlag := flag.String("memcache-read", "", "memcached host and port for reads (default is -memcache)")
 	serverFlag := flag.String("server", "", "the proxed server")
+	fallbacksFlag := flag.String("fallbacks", "", "comma-separated servers to try in order when -server fails")
+	sniffJSONFlag := flag.Bool("sniff-json", false, "accept responses without Content-Type if their body is JSON")
+	sniffLengthFlag := flag.Int("sniff-length", 512, "number of bytes of the body to check under -sniff-json")
+	proxyFlag := flag.String("proxy", "", "HTTP or SOCKS5 proxy URL for the server, overriding HTTP_PROXY and HTTPS_PROXY")
+	serverSocketFlag := flag.String("server-socket", "", "Unix socket to connect to the proxied server on")
+	upstreamTimeoutFlag := flag.Int("upstream-timeout", 60, "seconds a request to the server may take, including reading the body, before it fails with 504 (0 for no limit)")
 	portFlag := flag.Int("port", 8081, "port on which to listen")
 	expireDurationFlag := flag.Int("expire", 600, "expire duration in seconds")
 	numExpiresToDecayFlag := flag.Int("decay", 5, "number of expires for one decay")
 	durationThresholdFlag := flag.Int("refresh-duration", 200, "minimum duration in ms to reload")
+	autoTuneMaxFlag := flag.Int("autotune-max", 0, "maximum auto-tuned expire duration in seconds (0 disables auto-tuning)")
+	autoTuneLatencyFlag := flag.Int("autotune-latency", 1000, "average fetch duration in ms above which to lengthen the expire duration")
+	autoTuneErrorsFlag := flag.Float64("autotune-errors", 0.1, "fetch error rate above which to lengthen the expire duration")
+	breakerFlag := flag.Float64("breaker", 0, "fetch error rate above which to pause refreshes (0 disables)")
+	breakerCooldownFlag := flag.Int("breaker-cooldown", 60, "seconds to pause refreshes for when the upstream is failing")
+	presenceIntervalFlag := flag.Int("presence-interval", 0, "seconds between checks that cached data is still in memcached (0 disables)")
+	presenceSamplesFlag := flag.Int("presence-samples", 100, "number of entries to check in memcached per -presence-interval")
+	sizeBucketsFlag := flag.String("size-buckets", "", "comma-separated bucket bounds in bytes of the response size histogram")
+	rewriteURLsFlag := flag.String("rewrite-urls", "", "comma-separated from=to URL prefixes to rewrite in bodies, e.g. https://origin.example.com=https://cache.example.com")
+	promotionWindowFlag := flag.Int("promotion-window", 0, "refresh paths only once requested twice within this many seconds (0 refreshes all)")
+	maintenanceFileFlag := flag.String("maintenance-file", "", "JSON file to serve instead of fetching missing or expired data while paused")
+	maintenanceStatusFlag := flag.Int("maintenance-status", http.StatusServiceUnavailable, "status of the -maintenance-file response")
+	maintenanceRetryAfterFlag := flag.Int("maintenance-retry-after", 60, "seconds in the Retry-After header of the -maintenance-file response")
+	stubFileFlag := flag.String("stub-file", "", "JSON file to serve right away for missing data to requests with Prefer: respond-async, which can then long-poll for the data")
+	pollTimeoutFlag := flag.Int("poll-timeout", 30, "seconds a long-poll for data waits at most")
+	pauseBlocksFlag := flag.Bool("pause-blocks-fetches", false, "while paused, respond with 503 instead of fetching missing data")
+	checkLengthsFlag := flag.Bool("check-lengths", false, "fail fetches whose body doesn't match their Content-Length")
+	statsLabelsFlag := flag.String("stats-labels", "", "comma-separated entry label keys to break down fetch metrics by")
+	statsLabelValuesFlag := flag.Int("stats-label-values", 20, "number of distinct values per -stats-labels key before the rest count as other")
+	immutableFlag := flag.String("immutable", "", "comma-separated path patterns of immutable entries, which are never refreshed")
+	cacheableHeaderFlag := flag.String("cacheable-header", "", "response header which, if false, keeps the response from being cached, e.g. X-Cacheable")
+	slowFetchFlag := flag.Int("slow-fetch", 0, "fetch duration in ms above which an entry is slow (0 disables)")
+	slowFactorFlag := flag.Int("slow-factor", 1, "how many times less often slow entries are refetched")
+	etagHashFlag := flag.String("etag-hash", "sha256", "hash to compute ETags with: sha256, sha512, sha1 or fnv")
+	hedgeDelayFlag := flag.Int("hedge-delay", 0, "ms after which a fetch the server hasn't responded to is sent again, taking the first response (0 disables)")
+	maxHedgesFlag := flag.Int("max-hedges", 10, "maximum number of hedged requests under -hedge-delay running at a time")
+	cacheControlFlag := flag.Bool("honor-cache-control", false, "refetch entries after the max-age of their responses, and don't serve them past its stale-while-revalidate")
+	tokenWaitFlag := flag.Int("token-wait", 10, "seconds a request with an X-Refresh-Token waits for the refreshed data")
+	serveRevalidatingFlag := flag.Bool("serve-revalidating", false, "serve data past -serve-grace from memcache while -validate checks whether it changed")
+	skipUnchangedFlag := flag.Bool("skip-unchanged", false, "don't write refreshed data to memcache if its ETag is unchanged")
+	maxGoroutinesFlag := flag.Int("max-goroutines", 0, "maximum number of goroutines for fetches and cache writes (0 for unlimited)")
+	validateFlag := flag.Bool("validate", false, "check with a HEAD request whether data changed before refetching it")
+	queryFlag := flag.String("query", "exact", "how queries make distinct entries: exact, ignore or allowlist")
+	queryParamsFlag := flag.String("query-params", "", "comma-separated query parameters kept under -query allowlist")
+	queryRulesFlag := flag.String("query-rules", "", "query parameters kept for paths matching a pattern, overriding -query, e.g. /search=q,page;/products/*=id")
+	adminTokenFlag := flag.String("admin-token", "", "bearer token required for the admin endpoints")
+	primeConcurrencyFlag := flag.Int("prime-concurrency", 4, "number of paths to prime concurrently")
+	startDelayFlag := flag.Int("start-delay", 0, "maximum random delay in seconds before the first refresh")
+	verifyRateFlag := flag.Float64("verify-rate", 0, "fraction of cache hits to verify against the server")
+	waitersFlag := flag.String("waiters", "loop", "how to hand fetch results to waiting requests: loop, async or shed")
+	maxWaitersFlag := flag.Int("max-waiters", 1000, "maximum number of requests waiting for a fetch under -waiters shed")
+	readOnlyFlag := flag.Bool("read-only", false, "only serve what's in memcache, never contacting the server")
+	readOnlyStatusFlag := flag.Int("read-only-status", http.StatusNotFound, "status for paths not in memcache under -read-only")
+	replayHeadersFlag := flag.String("replay-headers", "", "comma-separated server headers to replay from the cache")
+	stripHeadersFlag := flag.String("strip-headers", "", "comma-separated headers never to replay (default is Set-Cookie, encoding and hop-by-hop headers)")
+	maxBytesFlag := flag.Int64("max-bytes", 0, "budget in bytes for cached data (0 for unlimited)")
+	evictionFlag := flag.String("eviction", "lru", "which entries to evict when over -max-bytes: lru, lfu, size or cost")
+	serveGraceFlag := flag.Int("serve-grace", -1, "ms after expiring that data is still served from memcache, instead of fetched (negative to always serve it)")
+	debugFlag := flag.Bool("debug", false, "log every cache and refresh decision")
+	snapshotFlag := flag.String("snapshot", "", "file to persist the keep's entries in")
+	snapshotFormatFlag := flag.String("snapshot-format", "gob", "format of the snapshot: gob or json")
+	snapshotBodiesFlag := flag.Bool("snapshot-bodies", false, "include the cached data in the snapshot, ignoring -snapshot-format")
+	snapshotIntervalFlag := flag.Int("snapshot-interval", 60, "interval in seconds for saving the snapshot")
+	encodingsFlag := flag.String("encodings", "", "comma-separated encodings to store variants in, out of gzip and zstd")
+	maxVariantsFlag := flag.Int("max-variants", keep.DefaultMaxVariants, "maximum number of variants stored per path")
+	normalizePathsFlag := flag.Bool("normalize-paths", false, "collapse duplicate slashes and resolve dot segments in paths before caching them")
+	fetchOriginalPathsFlag := flag.Bool("fetch-original-paths", false, "fetch paths under -normalize-paths as first requested, not normalized")
+	perEntryTimersFlag := flag.Bool("per-entry-timers", false, "give every entry its own refresh timer, which suits a handful of entries better than one schedule")
+	maxFetchesFlag := flag.Int("max-fetches", 0, "maximum number of concurrent background fetches (0 for unlimited)")
+	manifestFlag := flag.String("manifest", "", "URL or server path of a manifest listing paths to keep warm")
+	manifestFormatFlag := flag.String("manifest-format", "json", "format of the manifest: json or sitemap")
+	manifestIntervalFlag := flag.Int("manifest-interval", 300, "interval in seconds for reloading the manifest")
+	emptyBodyFlag := flag.String("empty-body", "serve", "what to do with empty upstream bodies: serve, no-content or reject")
+	clientPathsFlag := flag.Int("client-paths", 0, "maximum number of new paths a client can register per window (0 for unlimited)")
+	clientWindowFlag := flag.Int("client-window", 60, "window in seconds for -client-paths")
+	clientHeaderFlag := flag.String("client-header", "", "request header identifying the client by its last address, e.g. X-Forwarded-For set by a trusted proxy (default is the remote address)")
+	weightHeaderFlag := flag.String("weight-header", "", "request header giving the weight of a request, from 1 to 100, for keeping its path")
 
 	flag.Parse()
 
+	if *serverFlag == "" && *serverSocketFlag != "" {
+		// The host doesn't matter, we always connect to the socket.
+		*serverFlag = "http://localhost"
+	}
 	if *serverFlag == "" {
 		fmt.Fprintf(os.Stderr, "Error: -server option not given.\n")
 		os.Exit(1)
 	}
 
-	theMemcache = memcache.New(*memcacheFlag)
-	cache := memcacheCache{c: theMemcache, server: *serverFlag}
-	err := cache.c.DeleteAll()
+	var emptyBodyPolicy keep.EmptyBodyPolicy
+	switch *emptyBodyFlag {
+	case "serve":
+		emptyBodyPolicy = keep.EmptyBodyServe
+	case "no-content":
+		emptyBodyPolicy = keep.EmptyBodyNoContent
+	case "reject":
+		emptyBodyPolicy = keep.EmptyBodyReject
+	default:
+		fmt.Fprintf(os.Stderr, "Error: Unknown -empty-body policy %s.\n", *emptyBodyFlag)
+		os.Exit(1)
+	}
+
+	var err error
+	theQueryRule, err = parseQueryRule(*queryFlag, *queryParamsFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s.\n", err.Error())
+		os.Exit(1)
+	}
+	if *queryRulesFlag != "" {
+		thePathQueryRules, err = parsePathQueryRules(*queryRulesFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s.\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	waiterStrategy, ok := waiterStrategies[*waitersFlag]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: Unknown -waiters strategy %s.\n", *waitersFlag)
+		os.Exit(1)
+	}
+
+	evictionPolicy, ok := evictionPolicies[*evictionFlag]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: Unknown -eviction policy %s.\n", *evictionFlag)
+		os.Exit(1)
+	}
+
+	var snapshotFormat keep.SnapshotFormat
+	switch *snapshotFormatFlag {
+	case "gob":
+		snapshotFormat = keep.SnapshotGob
+	case "json":
+		snapshotFormat = keep.SnapshotJSON
+	default:
+		fmt.Fprintf(os.Stderr, "Error: Unknown -snapshot-format %s.\n", *snapshotFormatFlag)
+		os.Exit(1)
+	}
+
+	etagHash, ok := etagHashes[*etagHashFlag]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: Unknown -etag-hash %s.\n", *etagHashFlag)
+		os.Exit(1)
+	}
+
+	var manifestParser manifestParser
+	if *manifestFlag != "" {
+		var ok bool
+		manifestParser, ok = manifestParsers[*manifestFormatFlag]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Error: Unknown -manifest-format %s.\n", *manifestFormatFlag)
+			os.Exit(1)
+		}
+	}
+
+	if *clientPathsFlag > 0 {
+		thePathLimiter = newPathLimiter(*clientPathsFlag, time.Duration(*clientWindowFlag)*time.Second)
+	}
+	clientHeader = *clientHeaderFlag
+	weightHeader = *weightHeaderFlag
+	adminToken = *adminTokenFlag
+	if *primeConcurrencyFlag > 0 {
+		primeConcurrency = *primeConcurrencyFlag
+	}
+
+	upstreamClient, err := newUpstreamClient(*serverSocketFlag, *proxyFlag, time.Duration(*upstreamTimeoutFlag)*time.Second)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't flush memcache: %s\n", err.Error())
+		fmt.Fprintf(os.Stderr, "Error: Invalid -proxy: %s\n", err.Error())
+		os.Exit(1)
+	}
+	var fallbacks []string
+	if *fallbacksFlag != "" {
+		fallbacks = strings.Split(*fallbacksFlag, ",")
+	}
+	cache := memcacheCache{c: memcache.New(*memcacheFlag),
+		server:      *serverFlag,
+		fallbacks:   fallbacks,
+		client:      upstreamClient,
+		sniffJSON:   *sniffJSONFlag,
+		sniffLength: *sniffLengthFlag}
+	if !*readOnlyFlag {
+		err = cache.c.DeleteAll()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't flush memcache: %s\n", err.Error())
+		}
+	}
+	readOnlyStatus = *readOnlyStatusFlag
+	serveRevalidating = *serveRevalidatingFlag
+	normalizePaths = *normalizePathsFlag
+	fetchOriginalPaths = *normalizePathsFlag && *fetchOriginalPathsFlag
+	tokenWait = time.Duration(*tokenWaitFlag) * time.Second
+	if *serveGraceFlag >= 0 {
+		serveGrace = time.Duration(*serveGraceFlag) * time.Millisecond
+	}
+	theCache = cache
+	if *memcacheReadFlag != "" {
+		reader := cache
+		reader.c = memcache.New(*memcacheReadFlag)
+		theCache = keep.NewSplitCache(reader, cache)
+	}
+	if *namespaceFlag != "" {
+		theCache = keep.NewNamespacedCache(theCache, *namespaceFlag)
 	}
 
-	theKeep = keep.NewKeep(cache,
+	theKeep = keep.NewKeep(theCache,
 		time.Duration(*expireDurationFlag)*time.Second,
 		*numExpiresToDecayFlag,
 		time.Duration(*durationThresholdFlag)*time.Millisecond)
+	theKeep.SetEmptyBodyPolicy(emptyBodyPolicy)
+	theKeep.SetMaxFetches(*maxFetchesFlag)
+	theKeep.SetPerEntryTimers(*perEntryTimersFlag)
+	if fetchOriginalPaths {
+		theKeep.SetUpstreamMapper(upstreamPath)
+	}
+	theKeep.SetMaxGoroutines(*maxGoroutinesFlag)
+	theKeep.SetValidateRefreshes(*validateFlag)
+	theKeep.SetVerifyRate(*verifyRateFlag)
+	theKeep.SetReadOnly(*readOnlyFlag)
+	if *debugFlag {
+		debugLogger = log.New(os.Stdout, "debug: ", log.LstdFlags)
+		theKeep.SetLogger(debugLogger, keep.LogDebug)
+	}
+	theKeep.SetMaxBytes(*maxBytesFlag, evictionPolicy)
+	if *replayHeadersFlag != "" {
+		theKeep.SetReplayHeaders(strings.Split(*replayHeadersFlag, ","))
+	}
+	if *stripHeadersFlag != "" {
+		theKeep.SetStrippedHeaders(strings.Split(*stripHeadersFlag, ","))
+	}
+	theKeep.SetWaiterStrategy(waiterStrategy, *maxWaitersFlag)
+	theKeep.SetMaxStartDelay(time.Duration(*startDelayFlag) * time.Second)
+	theKeep.SetSnapshotFormat(snapshotFormat)
+	theKeep.SetBreaker(*breakerFlag, time.Duration(*breakerCooldownFlag)*time.Second, nil)
+	theKeep.SetCacheableHeader(*cacheableHeaderFlag)
+	theKeep.SetCheckLengths(*checkLengthsFlag)
+	theKeep.SetETagHash(etagHash)
+	theKeep.SetSkipUnchanged(*skipUnchangedFlag)
+	theKeep.SetHonorCacheControl(*cacheControlFlag)
+	theKeep.SetHedging(time.Duration(*hedgeDelayFlag)*time.Millisecond, *maxHedgesFlag)
+	theKeep.SetMaxVariants(*maxVariantsFlag)
+	if *instancesFlag > 1 {
+		theKeep.SetRefreshProbability(1 / float64(*instancesFlag))
+	}
+	theKeep.SetPauseBlocksFetches(*pauseBlocksFlag)
+	if *maintenanceFileFlag != "" {
+		maintenanceBody, err = ioutil.ReadFile(*maintenanceFileFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s.\n", err.Error())
+			os.Exit(1)
+		}
+		maintenanceStatus = *maintenanceStatusFlag
+		maintenanceRetryAfter = *maintenanceRetryAfterFlag
+	}
+	if *stubFileFlag != "" {
+		stubBody, err = ioutil.ReadFile(*stubFileFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s.\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	pollTimeout = time.Duration(*pollTimeoutFlag) * time.Second
+	if *statsLabelsFlag != "" {
+		err = theKeep.SetStatsLabels(strings.Split(*statsLabelsFlag, ","), *statsLabelValuesFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s.\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	theKeep.SetPromotionWindow(time.Duration(*promotionWindowFlag) * time.Second)
+	if *rewriteURLsFlag != "" {
+		var rewrites []keep.URLRewrite
+		for _, pair := range strings.Split(*rewriteURLsFlag, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				fmt.Fprintf(os.Stderr, "Error: Invalid -rewrite-urls %s.\n", pair)
+				os.Exit(1)
+			}
+			rewrites = append(rewrites, keep.URLRewrite{From: parts[0], To: parts[1]})
+		}
+		theKeep.AddTransform(keep.URLRewriteTransform(rewrites))
+	}
+	if *sizeBucketsFlag != "" {
+		var bounds []float64
+		for _, s := range strings.Split(*sizeBucketsFlag, ",") {
+			bound, err := strconv.ParseFloat(s, 64)
+			if err != nil || len(bounds) > 0 && bound <= bounds[len(bounds)-1] {
+				fmt.Fprintf(os.Stderr, "Error: Invalid -size-buckets.\n")
+				os.Exit(1)
+			}
+			bounds = append(bounds, bound)
+		}
+		theKeep.SetSizeBounds(bounds)
+	}
+	theKeep.SetPresenceCheck(time.Duration(*presenceIntervalFlag)*time.Second, *presenceSamplesFlag)
+	if *immutableFlag != "" {
+		err = theKeep.SetImmutablePatterns(strings.Split(*immutableFlag, ","))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s.\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	theKeep.SetSlowFetches(time.Duration(*slowFetchFlag)*time.Millisecond, *slowFactorFlag, nil)
+	if *encodingsFlag != "" {
+		theEncodings = strings.Split(*encodingsFlag, ",")
+		err = theKeep.SetEncodings(theEncodings)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s.\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	theKeep.SetAutoTune(time.Duration(*autoTuneMaxFlag)*time.Second,
+		time.Duration(*autoTuneLatencyFlag)*time.Millisecond,
+		*autoTuneErrorsFlag)
 	go theKeep.Run()
 
+	if *snapshotFlag != "" {
+		snapshotBodies = *snapshotBodiesFlag
+		err = restoreSnapshot(*snapshotFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't restore snapshot: %s\n", err.Error())
+		}
+		go saveSnapshots(*snapshotFlag, time.Duration(*snapshotIntervalFlag)*time.Second)
+	}
+
+	if *manifestFlag != "" {
+		manifestURL := *manifestFlag
+		if strings.HasPrefix(manifestURL, "/") {
+			manifestURL = *serverFlag + manifestURL
+		}
+		watcher := newManifestWatcher(manifestURL, manifestParser, time.Duration(*manifestIntervalFlag)*time.Second)
+		go watcher.run()
+	}
+
 	http.Handle("/", gziphandler.GzipHandler(http.HandlerFunc(cacheHandler)))
-	http.HandleFunc("/admin/keep", keepHandler)
+	http.HandleFunc(pollPath, pollHandler)
+	http.HandleFunc("/admin/keep", adminHandler(keepHandler))
+	http.HandleFunc("/admin/stats", adminHandler(statsHandler))
+	http.HandleFunc("/admin/errors", adminHandler(errorsHandler))
+	http.HandleFunc("/admin/health", healthHandler)
+	http.HandleFunc("/admin/metrics", adminHandler(metricsHandler))
+	http.HandleFunc("/admin/prime", adminHandler(primeHandler))
+	http.HandleFunc("/admin/warm", adminHandler(warmHandler))
+	http.HandleFunc("/admin/invalidate", adminHandler(invalidateHandler))
+	http.HandleFunc("/admin/refresh", adminHandler(refreshHandler))
+	http.HandleFunc("/admin/pause", adminHandler(pauseHandler(true)))
+	http.HandleFunc("/admin/resume", adminHandler(pauseHandler(false)))
+	http.HandleFunc("/admin/config", adminHandler(configHandler))
 	err = http.ListenAndServe(fmt.Sprintf(":%d", *portFlag), nil)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: Listen failed: %s\n", err.Error())
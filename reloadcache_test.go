@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/schani/reloadcache/keep"
+)
+
+// testCache is a Cache backed by a map, whose upstream serves bodies
+// set by the test, or "data" and the path.
+type testCache struct {
+	mu      sync.Mutex
+	data    map[string][]byte
+	bodies  map[string]string
+	errs    map[string]error
+	fetches map[string]int
+}
+
+func newTestCache() *testCache {
+	return &testCache{data: make(map[string][]byte),
+		bodies:  make(map[string]string),
+		errs:    make(map[string]error),
+		fetches: make(map[string]int)}
+}
+
+func (c *testCache) setBody(path string, body string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.bodies[path] = body
+}
+
+func (c *testCache) setErr(path string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errs[path] = err
+}
+
+func (c *testCache) fetchCount(path string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fetches[path]
+}
+
+func (c *testCache) Fetch(path string) (io.ReadCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fetches[path]++
+	if err := c.errs[path]; err != nil {
+		return nil, err
+	}
+	body, ok := c.bodies[path]
+	if !ok {
+		body = "data " + path
+	}
+	return ioutil.NopCloser(strings.NewReader(body)), nil
+}
+
+func (c *testCache) Get(path string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.data[path]
+	if !ok {
+		return nil, errors.New("not in cache")
+	}
+	return data, nil
+}
+
+func (c *testCache) Set(path string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data[path] = append([]byte(nil), data...)
+	return nil
+}
+
+func (c *testCache) Delete(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.data, path)
+	return nil
+}
+
+// useKeep makes the handlers use a keep for c, which caches fetches
+// that take at least threshold, and runs it.
+func useKeep(t *testing.T, c keep.Cache, threshold time.Duration) {
+	t.Helper()
+	theCache = c
+	theKeep = keep.NewKeep(c, time.Hour, 5, threshold)
+	go theKeep.Run()
+}
+
+// serve has h handle a request, and returns the response.
+func serve(h http.HandlerFunc, method string, target string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+// eventually waits for cond to hold.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// newUpstream returns a server that answers with status, and the ETag
+// and a JSON body if it's OK, counting requests by method.
+func newUpstream(t *testing.T, status int, etag string) (*httptest.Server, map[string]int) {
+	t.Helper()
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method]++
+		mu.Unlock()
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"path": "`+r.URL.Path+`"}`)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func TestValidatorFallsBack(t *testing.T) {
+	primary, primaryRequests := newUpstream(t, http.StatusServiceUnavailable, "")
+	fallback, fallbackRequests := newUpstream(t, http.StatusOK, `"v1"`)
+	c := memcacheCache{server: primary.URL, fallbacks: []string{fallback.URL}, client: http.DefaultClient}
+
+	validator, err := c.Validator("/a")
+	if err != nil || validator != `"v1"` {
+		t.Errorf("got validator %s, %v", validator, err)
+	}
+	if primaryRequests["HEAD"] != 1 || fallbackRequests["HEAD"] != 1 || fallbackRequests["GET"] != 0 {
+		t.Errorf("requests: primary %v, fallback %v", primaryRequests, fallbackRequests)
+	}
+
+	// Fetches fall back the same way.
+	body, err := c.Fetch("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	if body.(keep.ValidatedBody).Validator() != `"v1"` {
+		t.Errorf("fetched validator %s", body.(keep.ValidatedBody).Validator())
+	}
+}
+
+func TestValidatorContext(t *testing.T) {
+	upstream, requests := newUpstream(t, http.StatusOK, `"v1"`)
+	c := memcacheCache{server: upstream.URL, client: http.DefaultClient}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.ValidatorContext(ctx, "/a"); err == nil {
+		t.Error("got a validator with a cancelled context")
+	}
+	if requests["HEAD"] != 0 {
+		t.Errorf("%d requests with a cancelled context", requests["HEAD"])
+	}
+
+	missing, _ := newUpstream(t, http.StatusNotFound, "")
+	c = memcacheCache{server: missing.URL, client: http.DefaultClient}
+	if _, err := c.Validator("/a"); err == nil {
+		t.Error("got a validator for a missing path")
+	}
+}
+
+func TestServeFromReplica(t *testing.T) {
+	replica := newTestCache()
+	primary := newTestCache()
+	useKeep(t, keep.NewSplitCache(replica, primary), 0)
+
+	if err := theKeep.Prime("/a"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the data to be written to the primary", func() bool {
+		_, err := primary.Get("/a")
+		return err == nil
+	})
+	replica.Set("/a", []byte("replicated"))
+
+	w := serve(cacheHandler, "GET", "/a", "")
+	if w.Code != http.StatusOK || w.Body.String() != "replicated" {
+		t.Errorf("got status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestServeNoContent(t *testing.T) {
+	c := newTestCache()
+	c.setBody("/empty", "")
+	theCache = c
+	theKeep = keep.NewKeep(c, time.Hour, 5, 0)
+	theKeep.SetEmptyBodyPolicy(keep.EmptyBodyNoContent)
+	go theKeep.Run()
+
+	for i := 0; i < 2; i++ {
+		w := serve(cacheHandler, "GET", "/empty", "")
+		if w.Code != http.StatusNoContent || w.Body.Len() != 0 || w.Header().Get("Content-Type") != "" {
+			t.Errorf("request %d: got status %d, Content-Type %q: %q", i, w.Code, w.Header().Get("Content-Type"), w.Body)
+		}
+		eventually(t, "the empty body to be cached", func() bool {
+			_, err := c.Get("/empty")
+			return err == nil
+		})
+	}
+	if n := c.fetchCount("/empty"); n != 1 {
+		t.Errorf("%d fetches", n)
+	}
+}
+
+// newTypedUpstream returns a server that answers with body and the
+// Content-Type contentType, or none if it's empty.
+func newTypedUpstream(t *testing.T, contentType string, body string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contentType == "" {
+			// Keeps the server from detecting one.
+			w.Header()["Content-Type"] = nil
+		} else {
+			w.Header().Set("Content-Type", contentType)
+		}
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// fetchFrom fetches /a through c from a server answering with body and
+// the Content-Type contentType.
+func fetchFrom(t *testing.T, c memcacheCache, contentType string, body string) (string, error) {
+	t.Helper()
+	c.server = newTypedUpstream(t, contentType, body).URL
+	c.client = http.DefaultClient
+	resp, err := c.Fetch("/a")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Close()
+	data, err := ioutil.ReadAll(resp)
+	return string(data), err
+}
+
+func TestMissingContentType(t *testing.T) {
+	if _, err := fetchFrom(t, memcacheCache{}, "", `{"a": 1}`); err == nil {
+		t.Error("accepted a body without Content-Type")
+	}
+
+	sniffing := memcacheCache{sniffJSON: true, sniffLength: 16}
+	long := `{"a": "` + strings.Repeat("x", 100) + `"}`
+	for _, body := range []string{`{"a": 1}`, `[1, 2]`, long} {
+		data, err := fetchFrom(t, sniffing, "", body)
+		if err != nil || data != body {
+			t.Errorf("sniffing %q: got %q, %v", body, data, err)
+		}
+	}
+	for _, body := range []string{"<html></html>", `{"a": `, ""} {
+		if _, err := fetchFrom(t, sniffing, "", body); err == nil {
+			t.Errorf("sniffing accepted %q", body)
+		}
+	}
+	// A Content-Type is still checked.
+	if _, err := fetchFrom(t, sniffing, "text/html", `{"a": 1}`); err == nil {
+		t.Error("sniffing accepted text/html")
+	}
+}
+
+func TestContentTypeCasing(t *testing.T) {
+	for _, contentType := range []string{"application/json", "Application/JSON", "application/JSON; charset=utf-8", "APPLICATION/json;charset=UTF-8"} {
+		if _, err := fetchFrom(t, memcacheCache{}, contentType, `{"a": 1}`); err != nil {
+			t.Errorf("rejected %q: %v", contentType, err)
+		}
+	}
+	for _, contentType := range []string{"text/json", "application/json-seq", "application/json; charset", ";"} {
+		if _, err := fetchFrom(t, memcacheCache{}, contentType, `{"a": 1}`); err == nil {
+			t.Errorf("accepted %q", contentType)
+		}
+	}
+}
+
+func TestServeReadOnly(t *testing.T) {
+	c := newTestCache()
+	c.Set("/a", []byte("frozen"))
+	theCache = c
+	theKeep = keep.NewKeep(c, time.Hour, 5, 0)
+	theKeep.SetReadOnly(true)
+	go theKeep.Run()
+	defer func() { readOnlyStatus = http.StatusNotFound }()
+
+	if w := serve(cacheHandler, "GET", "/a", ""); w.Code != http.StatusOK || w.Body.String() != "frozen" {
+		t.Errorf("got status %d: %s", w.Code, w.Body)
+	}
+	if w := serve(cacheHandler, "GET", "/b", ""); w.Code != http.StatusNotFound {
+		t.Errorf("got status %d for a missing path", w.Code)
+	}
+	readOnlyStatus = http.StatusServiceUnavailable
+	if w := serve(cacheHandler, "GET", "/b", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d with -read-only-status 503", w.Code)
+	}
+	if n := c.fetchCount("/a") + c.fetchCount("/b"); n != 0 {
+		t.Errorf("%d fetches", n)
+	}
+}
+
+func TestServeMaxServedAge(t *testing.T) {
+	c := newTestCache()
+	useKeep(t, c, 0)
+
+	get := func() {
+		if w := serve(cacheHandler, "GET", "/a", ""); w.Code != http.StatusOK || w.Body.String() != "data /a" {
+			t.Errorf("got status %d: %s", w.Code, w.Body)
+		}
+		eventually(t, "the data to be cached", func() bool {
+			_, err := c.Get("/a")
+			return err == nil
+		})
+	}
+	get()
+	theKeep.SetMaxServedAge("/a", 200*time.Millisecond)
+
+	// Just under the maximum age it's served from the cache,
+	get()
+	if n := c.fetchCount("/a"); n != 1 {
+		t.Errorf("%d fetches under the maximum age", n)
+	}
+	// and just over it, it's fetched, even though stale data is
+	// otherwise served.
+	time.Sleep(250 * time.Millisecond)
+	get()
+	if n := c.fetchCount("/a"); n != 2 {
+		t.Errorf("%d fetches over the maximum age", n)
+	}
+}
+
+func TestServeCountsHits(t *testing.T) {
+	c := newTestCache()
+	useKeep(t, c, 0)
+
+	for i := 0; i < 3; i++ {
+		if w := serve(cacheHandler, "GET", "/a", ""); w.Code != http.StatusOK {
+			t.Fatalf("got status %d", w.Code)
+		}
+		eventually(t, "the data to be cached", func() bool {
+			_, err := c.Get("/a")
+			return err == nil
+		})
+	}
+	// The first request was a miss.
+	if stats := theKeep.Stats(); stats.Hits != 2 || stats.BytesSaved != 2*int64(len("data /a")) {
+		t.Errorf("got %d hits saving %d bytes", stats.Hits, stats.BytesSaved)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/schani/reloadcache/keep"
+)
+
+type validatedBody struct {
+	io.ReadCloser
+	validator string
+}
+
+func (b validatedBody) Validator() string {
+	return b.validator
+}
+
+// slowValidatingCache is a testCache whose upstream has the validator
+// "v1", and whose validator requests block until released.
+type slowValidatingCache struct {
+	*testCache
+	validating chan struct{}
+	release    chan struct{}
+}
+
+func (c *slowValidatingCache) Fetch(path string) (io.ReadCloser, error) {
+	body, err := c.testCache.Fetch(path)
+	return validatedBody{ReadCloser: body, validator: "v1"}, err
+}
+
+func (c *slowValidatingCache) Validator(path string) (string, error) {
+	c.validating <- struct{}{}
+	<-c.release
+	return "v1", nil
+}
+
+func TestServeWhileRevalidating(t *testing.T) {
+	c := &slowValidatingCache{testCache: newTestCache(), validating: make(chan struct{}, 10), release: make(chan struct{})}
+	theCache = c
+	theKeep = keep.NewKeep(c, 50*time.Millisecond, 5, 0)
+	theKeep.SetValidateRefreshes(true)
+	go theKeep.Run()
+	serveGrace = 0
+	serveRevalidating = true
+	defer func() {
+		close(c.release)
+		serveGrace = -1
+		serveRevalidating = false
+	}()
+
+	if w := serve(cacheHandler, "GET", "/a", ""); w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	eventually(t, "the data to be cached", func() bool {
+		_, err := c.Get("/a")
+		return err == nil
+	})
+
+	// The data expires and its revalidation hangs.
+	select {
+	case <-c.validating:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the revalidation")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := serve(cacheHandler, "GET", "/a", "")
+			if w.Code != http.StatusOK || w.Body.String() != "data /a" {
+				t.Errorf("got status %d: %s", w.Code, w.Body)
+			}
+		}()
+	}
+	served := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(served)
+	}()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("requests blocked on the revalidation")
+	}
+	if n := c.fetchCount("/a"); n != 1 {
+		t.Errorf("%d fetches during the revalidation", n)
+	}
+}
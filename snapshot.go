@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Whether snapshots include the cached data.
+var snapshotBodies bool
+
+// restoreSnapshot loads the keep's entries from the snapshot at path,
+// if there is one.
+func restoreSnapshot(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if snapshotBodies {
+		return theKeep.Import(file)
+	}
+	return theKeep.ReadSnapshot(file)
+}
+
+// saveSnapshot writes a snapshot of the keep's entries to path,
+// replacing it atomically.
+func saveSnapshot(path string) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	if snapshotBodies {
+		err = theKeep.Export(file)
+	} else {
+		err = theKeep.WriteSnapshot(file)
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func saveSnapshots(path string, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		err := saveSnapshot(path)
+		if err != nil {
+			fmt.Printf("snapshot error: %s\n", err.Error())
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/schani/reloadcache/keep"
+)
+
+func TestStaleWarning(t *testing.T) {
+	c := newTestCache()
+	theCache = c
+	theKeep = keep.NewKeep(c, 50*time.Millisecond, 5, 0)
+	go theKeep.Run()
+	theKeep.Pause()
+
+	for _, path := range []string{"/a", "/b"} {
+		if err := theKeep.Prime(path); err != nil {
+			t.Fatal(err)
+		}
+		eventually(t, path+" to be cached", func() bool {
+			_, err := c.Get(path)
+			return err == nil
+		})
+	}
+	if w := serve(cacheHandler, "GET", "/a", ""); w.Code != http.StatusOK || w.Header().Get("Warning") != "" {
+		t.Errorf("got status %d, Warning %q for fresh data", w.Code, w.Header().Get("Warning"))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	w := serve(cacheHandler, "GET", "/a", "")
+	if w.Code != http.StatusOK || w.Header().Get("Warning") != `110 reloadcache "Response is Stale"` {
+		t.Errorf("got status %d, Warning %q for stale data", w.Code, w.Header().Get("Warning"))
+	}
+
+	// Once refreshing /b fails, serving it says so.
+	c.setErr("/b", errors.New("upstream down"))
+	theKeep.Resume()
+	eventually(t, "the refresh to fail", func() bool { return theKeep.Failing("/b") })
+	theKeep.Pause()
+	w = serve(cacheHandler, "GET", "/b", "")
+	if w.Code != http.StatusOK || w.Header().Get("Warning") != `111 reloadcache "Revalidation Failed"` {
+		t.Errorf("got status %d, Warning %q for data failing to refresh", w.Code, w.Header().Get("Warning"))
+	}
+}
+
+// heldCache is a testCache whose fetches block while it's held.
+type heldCache struct {
+	*testCache
+	mu      sync.Mutex
+	gate    chan struct{}
+	started chan string
+}
+
+func (c *heldCache) hold() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gate = make(chan struct{})
+}
+
+func (c *heldCache) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	close(c.gate)
+	c.gate = nil
+}
+
+func (c *heldCache) Fetch(path string) (io.ReadCloser, error) {
+	c.mu.Lock()
+	gate := c.gate
+	c.mu.Unlock()
+	c.started <- path
+	if gate != nil {
+		<-gate
+	}
+	return c.testCache.Fetch(path)
+}
+
+func TestGraceRefreshWhileFetching(t *testing.T) {
+	c := &heldCache{testCache: newTestCache(), started: make(chan string, 10)}
+	theCache = c
+	theKeep = keep.NewKeep(c, 300*time.Millisecond, 5, 0)
+	go theKeep.Run()
+	serveGrace = time.Hour
+	defer func() { serveGrace = -1 }()
+
+	if err := theKeep.Prime("/a"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the data to be cached", func() bool {
+		_, err := c.Get("/a")
+		return err == nil
+	})
+	<-c.started
+
+	// The data expires, and is served stale while it's refetched.
+	c.hold()
+	select {
+	case <-c.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the refetch")
+	}
+	for i := 0; i < 2; i++ {
+		if w := serve(cacheHandler, "GET", "/a", ""); w.Code != http.StatusOK || w.Body.String() != "data /a" {
+			t.Errorf("got status %d: %s", w.Code, w.Body)
+		}
+	}
+	c.release()
+	eventually(t, "the refetch to finish", func() bool { return theKeep.ExpiredBy("/a") < 0 })
+
+	time.Sleep(100 * time.Millisecond)
+	if n := c.fetchCount("/a"); n != 2 {
+		t.Errorf("%d fetches, want one refetch", n)
+	}
+}
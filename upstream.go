@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// newUpstreamClient returns the client for requests to the server.  If
+// socket is given, all requests go to that Unix socket, whatever the
+// host in their URL, and no proxy is used.  Otherwise, if proxy is
+// given, requests go through it, which can be an HTTP, HTTPS or SOCKS5
+// proxy URL.  If neither is given, the HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY environment variables are honored.  A request that takes
+// longer than timeout, including reading its body, fails with a
+// timeout error.  Zero means no timeout.
+func newUpstreamClient(socket string, proxy string, timeout time.Duration) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if socket != "" {
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	} else if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	} else {
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
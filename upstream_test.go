@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpstreamSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "upstream.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("can't listen on a Unix socket: %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"path": "`+r.URL.Path+`"}`)
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	client, err := newUpstreamClient(socket, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The host is a placeholder, as with -server-socket.
+	c := memcacheCache{server: "http://localhost", client: client}
+	body, err := c.Fetch("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil || string(data) != `{"path": "/a"}` {
+		t.Errorf("fetched %q, %v", data, err)
+	}
+
+	if _, err := newUpstreamClient("", "://bad", 0); err == nil {
+		t.Error("accepted an invalid proxy")
+	}
+}
+
+// recordingReader records whether it was read.
+type recordingReader struct {
+	read bool
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	r.read = true
+	return 0, io.EOF
+}
+
+func TestUpstreamClientExpectContinue(t *testing.T) {
+	// The origin rejects requests before their body is sent.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusExpectationFailed)
+	}))
+	defer server.Close()
+
+	for _, proxy := range []string{"", "http://proxy.invalid"} {
+		client, err := newUpstreamClient("", proxy, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client.Transport.(*http.Transport).ExpectContinueTimeout <= 0 {
+			t.Errorf("proxy %q: the client doesn't wait for 100 Continue", proxy)
+		}
+	}
+
+	client, _ := newUpstreamClient("", "", 0)
+	body := &recordingReader{}
+	req, _ := http.NewRequest("POST", server.URL, body)
+	req.ContentLength = 1 << 20
+	req.Header.Set("Expect", "100-continue")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusExpectationFailed || body.read {
+		t.Errorf("got status %d, body read: %v", resp.StatusCode, body.read)
+	}
+}
+
+// upstreamOnlyCache is a testCache that fetches from upstream.
+type upstreamOnlyCache struct {
+	*testCache
+	upstream memcacheCache
+}
+
+func (c upstreamOnlyCache) Fetch(path string) (io.ReadCloser, error) {
+	return c.upstream.Fetch(path)
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	hung := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hung:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(hung)
+
+	client, err := newUpstreamClient("", "", 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useKeep(t, upstreamOnlyCache{testCache: newTestCache(), upstream: memcacheCache{server: server.URL, client: client}}, 0)
+
+	w := serve(cacheHandler, "GET", "/a", "")
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("got status %d for a hung upstream", w.Code)
+	}
+	for _, ei := range theKeep.Dump() {
+		if ei.Fetching {
+			t.Errorf("the fetch of %s is still running", ei.Path)
+		}
+	}
+}